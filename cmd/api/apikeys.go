@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/thats-insane/awt-test3/internal/data"
+	"github.com/thats-insane/awt-test3/internal/validator"
+)
+
+/* Create a new API key for the current user */
+func (a *appDependencies) createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	user := a.ctxGetUser(r)
+
+	var incomingData struct {
+		Name   string     `json:"name"`
+		Scopes []string   `json:"scopes"`
+		Expiry *time.Time `json:"expiry"`
+	}
+	err := a.readJSON(w, r, &incomingData)
+	if err != nil {
+		a.badRequest(w, r, err)
+		return
+	}
+
+	permissions, err := a.permissionModel.GetAllForUser(user.ID)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	key := &data.APIKey{
+		UserID: user.ID,
+		Name:   incomingData.Name,
+		Scopes: incomingData.Scopes,
+		Expiry: incomingData.Expiry,
+	}
+
+	v := validator.New()
+	data.ValidateAPIKey(v, key, permissions)
+	if !v.IsEmpty() {
+		a.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	err = a.apiKeyModel.New(key)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/api/v1/users/me/api-keys/%d", key.ID))
+	data := envelope{
+		"api_key": key,
+		"message": "store this key somewhere safe as it will not be shown again",
+	}
+
+	err = a.writeJSON(w, http.StatusCreated, data, headers)
+	if err != nil {
+		a.serverErr(w, r, err)
+	}
+}
+
+/* Display the current user's API keys */
+func (a *appDependencies) listAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	user := a.ctxGetUser(r)
+
+	keys, err := a.apiKeyModel.GetAllForUser(user.ID)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	data := envelope{
+		"api_keys": keys,
+	}
+
+	err = a.writeJSON(w, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErr(w, r, err)
+	}
+}
+
+/* Revoke one of the current user's API keys */
+func (a *appDependencies) deleteAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := a.readIDParam(r)
+	if err != nil {
+		a.notFound(w, r)
+		return
+	}
+
+	err = a.apiKeyModel.Delete(id, a.ctxGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.notFound(w, r)
+		default:
+			a.serverErr(w, r, err)
+		}
+		return
+	}
+
+	data := envelope{
+		"message": "api key successfully revoked",
+	}
+
+	err = a.writeJSON(w, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErr(w, r, err)
+	}
+}
@@ -14,13 +14,13 @@ import (
 /* Create a new book */
 func (a *appDependencies) createBookHandler(w http.ResponseWriter, r *http.Request) {
 	var incomingData struct {
-		Title     string    `json:"title"`
-		Author    string    `json:"author"`
-		ISBN      string    `json:"isbn"`
-		PubDate   time.Time `json:"pub_date"`
-		Genre     string    `json:"genre"`
-		Desc      string    `json:"description"`
-		AvgRating float64   `json:"avg_rating"`
+		Title    string    `json:"title"`
+		Author   string    `json:"author"`
+		ISBN     string    `json:"isbn"`
+		PubDate  time.Time `json:"pub_date"`
+		Genre    string    `json:"genre"`
+		Desc     string    `json:"description"`
+		Language string    `json:"language"`
 	}
 	err := a.readJSON(w, r, &incomingData)
 	if err != nil {
@@ -29,13 +29,16 @@ func (a *appDependencies) createBookHandler(w http.ResponseWriter, r *http.Reque
 	}
 
 	book := &data.Book{
-		Title:     incomingData.Title,
-		Author:    incomingData.Author,
-		ISBN:      incomingData.ISBN,
-		Genre:     incomingData.Genre,
-		Desc:      incomingData.Desc,
-		PubDate:   incomingData.PubDate,
-		AvgRating: incomingData.AvgRating,
+		Title:    incomingData.Title,
+		Author:   incomingData.Author,
+		ISBN:     incomingData.ISBN,
+		Genre:    incomingData.Genre,
+		Desc:     incomingData.Desc,
+		PubDate:  incomingData.PubDate,
+		Language: incomingData.Language,
+	}
+	if book.Language == "" {
+		book.Language = a.config.search.language
 	}
 	v := validator.New()
 	data.ValidateBook(v, book)
@@ -67,8 +70,6 @@ func (a *appDependencies) createBookHandler(w http.ResponseWriter, r *http.Reque
 		a.serverErr(w, r, err)
 		return
 	}
-
-	fmt.Fprintf(w, "%+v\n", incomingData)
 }
 
 /* Display a book */
@@ -79,6 +80,13 @@ func (a *appDependencies) displayBookHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	v := validator.New()
+	fields := a.getFieldsParameters(r.URL.Query(), data.Book{}, v)
+	if !v.IsEmpty() {
+		a.failedValidation(w, r, v.Errors)
+		return
+	}
+
 	book, err := a.bookModel.Get(id)
 	if err != nil {
 		switch {
@@ -90,8 +98,14 @@ func (a *appDependencies) displayBookHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	presented, err := a.sparse(book, fields)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
 	data := envelope{
-		"book": book,
+		"book": presented,
 	}
 
 	err = a.writeJSON(w, http.StatusOK, data, nil)
@@ -121,13 +135,13 @@ func (a *appDependencies) updateBookHandler(w http.ResponseWriter, r *http.Reque
 	}
 
 	var incomingData struct {
-		Title     *string    `json:"title"`
-		Author    *string    `json:"author"`
-		PubDate   *time.Time `json:"pub_date"`
-		ISBN      *string    `json:"isbn"`
-		Genre     *string    `json:"genre"`
-		Desc      *string    `json:"description"`
-		AvgRating *int       `json:"avg_rating"`
+		Title    *string    `json:"title"`
+		Author   *string    `json:"author"`
+		PubDate  *time.Time `json:"pub_date"`
+		ISBN     *string    `json:"isbn"`
+		Genre    *string    `json:"genre"`
+		Desc     *string    `json:"description"`
+		Language *string    `json:"language"`
 	}
 	err = a.readJSON(w, r, &incomingData)
 	if err != nil {
@@ -135,6 +149,28 @@ func (a *appDependencies) updateBookHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	if incomingData.Title != nil {
+		book.Title = *incomingData.Title
+	}
+	if incomingData.Author != nil {
+		book.Author = *incomingData.Author
+	}
+	if incomingData.PubDate != nil {
+		book.PubDate = *incomingData.PubDate
+	}
+	if incomingData.ISBN != nil {
+		book.ISBN = *incomingData.ISBN
+	}
+	if incomingData.Genre != nil {
+		book.Genre = *incomingData.Genre
+	}
+	if incomingData.Desc != nil {
+		book.Desc = *incomingData.Desc
+	}
+	if incomingData.Language != nil {
+		book.Language = *incomingData.Language
+	}
+
 	v := validator.New()
 	data.ValidateBook(v, book)
 	if !v.IsEmpty() {
@@ -142,9 +178,14 @@ func (a *appDependencies) updateBookHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	err = a.bookModel.Update(book, id)
+	err = a.bookModel.Update(book)
 	if err != nil {
-		a.serverErr(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.notFound(w, r)
+		default:
+			a.serverErr(w, r, err)
+		}
 		return
 	}
 
@@ -188,24 +229,50 @@ func (a *appDependencies) deleteBookHandler(w http.ResponseWriter, r *http.Reque
 	}
 }
 
-/* List all books */
+/* List all books, narrowed by the optional filters, with genre and decade facet counts */
 func (a *appDependencies) listBooksHandler(w http.ResponseWriter, r *http.Request) {
 	var queryParametersData struct {
+		Fields []string
+		data.BookFilters
 		data.Filters
 	}
 	queryParameters := r.URL.Query()
+	queryParametersData.Genres = a.getMultipleQueryParameters(queryParameters, "genre")
+	queryParametersData.Author = a.getSingleQueryParameters(queryParameters, "author", "")
 	queryParametersData.Filters.Sort = a.getSingleQueryParameters(queryParameters, "sort", "id")
-	queryParametersData.Filters.SortSafeList = []string{"id", "-id"}
+	queryParametersData.Filters.SortColumns = data.BookSortColumns
 	v := validator.New()
+	queryParametersData.Fields = a.getFieldsParameters(queryParameters, data.Book{}, v)
+	queryParametersData.YearFrom = a.getSingleIntegerParameters(queryParameters, "year_from", 0, v)
+	queryParametersData.YearTo = a.getSingleIntegerParameters(queryParameters, "year_to", 0, v)
+	queryParametersData.MinRating = a.getSingleFloatParameters(queryParameters, "min_rating", 0, v)
+	queryParametersData.HasReviews = a.getOptionalBoolParameters(queryParameters, "has_reviews", v)
 	queryParametersData.Filters.Page = a.getSingleIntegerParameters(queryParameters, "page", 1, v)
 	queryParametersData.Filters.PageSize = a.getSingleIntegerParameters(queryParameters, "page_size", 10, v)
+	queryParametersData.Filters.Cursor = a.getSingleQueryParameters(queryParameters, "cursor", "")
+	data.ValidateBookFilters(v, queryParametersData.BookFilters)
 	data.ValidateFilters(v, queryParametersData.Filters)
 	if !v.IsEmpty() {
 		a.failedValidation(w, r, v.Errors)
 		return
 	}
 
-	book, metadata, err := a.bookModel.GetAll(queryParametersData.Filters)
+	books, metadata, err := a.bookModel.GetAll(queryParametersData.BookFilters, queryParametersData.Filters)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	book := make([]envelope, len(books))
+	for i := range books {
+		book[i], err = a.sparse(books[i], queryParametersData.Fields)
+		if err != nil {
+			a.serverErr(w, r, err)
+			return
+		}
+	}
+
+	facets, err := a.bookModel.Facets(queryParametersData.BookFilters)
 	if err != nil {
 		a.serverErr(w, r, err)
 		return
@@ -213,44 +280,92 @@ func (a *appDependencies) listBooksHandler(w http.ResponseWriter, r *http.Reques
 
 	data := envelope{
 		"book":      book,
+		"@facets":   facets,
 		"@metadata": metadata,
 	}
 
-	err = a.writeJSON(w, http.StatusOK, data, nil)
+	err = a.writeJSON(w, http.StatusOK, data, a.paginationLinks(r, metadata))
 	if err != nil {
 		a.serverErr(w, r, err)
 	}
 }
 
-/* Search for a book based on filters */
+/* Full-text search for books, ranked by relevance */
 func (a *appDependencies) searchBooksHandler(w http.ResponseWriter, r *http.Request) {
 	var queryParametersData struct {
-		Title  string
-		Author string
-		Genre  string
+		Q        string
+		Language string
+		Mode     string
 		data.Filters
 	}
 	queryParameters := r.URL.Query()
-	queryParametersData.Title = a.getSingleQueryParameters(queryParameters, "title", "")
-	queryParametersData.Author = a.getSingleQueryParameters(queryParameters, "author", "")
-	queryParametersData.Genre = a.getSingleQueryParameters(queryParameters, "genre", "")
+	queryParametersData.Q = a.getSingleQueryParameters(queryParameters, "q", "")
+	queryParametersData.Language = a.getSingleQueryParameters(queryParameters, "lang", a.config.search.language)
+	queryParametersData.Mode = a.getSingleQueryParameters(queryParameters, "mode", data.SearchModeFullText)
+	// results are always ordered by relevance
+	queryParametersData.Filters.Sort = "rank"
+	queryParametersData.Filters.SortColumns = map[string]string{"rank": "rank"}
 	v := validator.New()
+	queryParametersData.Filters.Page = a.getSingleIntegerParameters(queryParameters, "page", 1, v)
+	queryParametersData.Filters.PageSize = a.getSingleIntegerParameters(queryParameters, "page_size", 10, v)
+	data.ValidateSearch(v, queryParametersData.Q, queryParametersData.Language, queryParametersData.Mode)
 	data.ValidateFilters(v, queryParametersData.Filters)
 	if !v.IsEmpty() {
 		a.failedValidation(w, r, v.Errors)
 		return
 	}
 
-	book, metadata, err := a.bookModel.Search(queryParametersData.Title, queryParametersData.Author, queryParametersData.Genre, queryParametersData.Filters)
+	books, metadata, err := a.bookModel.Search(queryParametersData.Q, queryParametersData.Language, queryParametersData.Mode, queryParametersData.Filters)
 	if err != nil {
 		a.serverErr(w, r, err)
 		return
 	}
 
+	// nothing matched the exact words, offer close spellings instead
+	var suggestions []string
+	if len(books) == 0 && queryParametersData.Mode == data.SearchModeFullText {
+		suggestions, err = a.bookModel.Suggest(queryParametersData.Q, 5)
+		if err != nil {
+			a.serverErr(w, r, err)
+			return
+		}
+	}
+
 	data := envelope{
-		"book":      book,
+		"book":      books,
 		"@metadata": metadata,
 	}
+	if suggestions != nil {
+		data["did_you_mean"] = suggestions
+	}
+
+	err = a.writeJSON(w, http.StatusOK, data, a.paginationLinks(r, metadata))
+	if err != nil {
+		a.serverErr(w, r, err)
+	}
+}
+
+/* Complete a search box prefix with matching titles and authors */
+func (a *appDependencies) autocompleteBooksHandler(w http.ResponseWriter, r *http.Request) {
+	queryParameters := r.URL.Query()
+	prefix := a.getSingleQueryParameters(queryParameters, "prefix", "")
+	v := validator.New()
+	limit := a.getSingleIntegerParameters(queryParameters, "limit", 5, v)
+	data.ValidateAutocomplete(v, prefix, limit)
+	if !v.IsEmpty() {
+		a.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	completions, err := a.bookModel.Autocomplete(prefix, limit)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	data := envelope{
+		"completions": completions,
+	}
 
 	err = a.writeJSON(w, http.StatusOK, data, nil)
 	if err != nil {
@@ -10,6 +10,9 @@ import (
 type ctxKey string
 
 const userCtxKey = ctxKey("user")
+const tokenCtxKey = ctxKey("token")
+const claimsOnlyCtxKey = ctxKey("claimsOnly")
+const scopesCtxKey = ctxKey("scopes")
 
 func (a *appDependencies) ctxSetUser(r *http.Request, user *data.User) *http.Request {
 	ctx := context.WithValue(r.Context(), userCtxKey, user)
@@ -24,3 +27,45 @@ func (a *appDependencies) ctxGetUser(r *http.Request) *data.User {
 
 	return user
 }
+
+func (a *appDependencies) ctxSetToken(r *http.Request, plaintext string) *http.Request {
+	ctx := context.WithValue(r.Context(), tokenCtxKey, plaintext)
+	return r.WithContext(ctx)
+}
+
+/* Returns the bearer token used for this request, or an empty string if there isn't one */
+func (a *appDependencies) ctxGetToken(r *http.Request) string {
+	plaintext, _ := r.Context().Value(tokenCtxKey).(string)
+	return plaintext
+}
+
+/* Stores a user built only from JWT claims, the rest of the record is loaded on demand */
+func (a *appDependencies) ctxSetClaimsUser(r *http.Request, user *data.User) *http.Request {
+	ctx := context.WithValue(r.Context(), userCtxKey, user)
+	ctx = context.WithValue(ctx, claimsOnlyCtxKey, true)
+	return r.WithContext(ctx)
+}
+
+/* Returns the complete user record, fetching it if the context only holds JWT claims */
+func (a *appDependencies) ctxGetFullUser(r *http.Request) (*data.User, error) {
+	user := a.ctxGetUser(r)
+
+	claimsOnly, _ := r.Context().Value(claimsOnlyCtxKey).(bool)
+	if !claimsOnly || user.IsAnon() {
+		return user, nil
+	}
+
+	return a.userModel.Get(user.ID)
+}
+
+/* Limits the request to the given permission scopes (used for API keys) */
+func (a *appDependencies) ctxSetScopes(r *http.Request, scopes []string) *http.Request {
+	ctx := context.WithValue(r.Context(), scopesCtxKey, scopes)
+	return r.WithContext(ctx)
+}
+
+/* Returns the scopes the request is limited to, nil means the credentials are not scoped */
+func (a *appDependencies) ctxGetScopes(r *http.Request) []string {
+	scopes, _ := r.Context().Value(scopesCtxKey).([]string)
+	return scopes
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 func (a *appDependencies) logErr(r *http.Request, err error) {
@@ -76,3 +78,32 @@ func (a *appDependencies) invalidCredentials(w http.ResponseWriter, r *http.Requ
 	msg := "invalid auth credentials"
 	a.errResponseJSON(w, r, http.StatusUnauthorized, msg)
 }
+
+func (a *appDependencies) notPermitted(w http.ResponseWriter, r *http.Request) {
+	msg := "your user account doesn't have the necessary permissions to access this resource"
+	a.errResponseJSON(w, r, http.StatusForbidden, msg)
+}
+
+func (a *appDependencies) statelessToken(w http.ResponseWriter, r *http.Request) {
+	msg := "sessions are not tracked when the server uses jwt authentication, tokens remain valid until they expire"
+	a.errResponseJSON(w, r, http.StatusBadRequest, msg)
+}
+
+func (a *appDependencies) accountLocked(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+	msg := "this account is temporarily locked due to too many failed login attempts, try again later"
+	a.errResponseJSON(w, r, http.StatusTooManyRequests, msg)
+}
+
+/* OAuth2 endpoints report errors in the format from RFC 6749 section 5.2 */
+func (a *appDependencies) oauthErr(w http.ResponseWriter, r *http.Request, status int, code string, description string) {
+	errMsg := envelope{
+		"error":             code,
+		"error_description": description,
+	}
+	err := a.writeJSON(w, status, errMsg, http.Header{"Cache-Control": {"no-store"}})
+	if err != nil {
+		a.logErr(r, err)
+		w.WriteHeader(500)
+	}
+}
@@ -1,16 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"reflect"
 	"strconv"
 	"strings"
 
-	"github.com/julienschmidt/httprouter"
+	"github.com/thats-insane/awt-test3/internal/data"
 	"github.com/thats-insane/awt-test3/internal/validator"
 )
 
@@ -99,9 +101,7 @@ func (a *appDependencies) writeJSON(w http.ResponseWriter, status int, data enve
 }
 
 func (a *appDependencies) readIDParam(r *http.Request) (int64, error) {
-	params := httprouter.ParamsFromContext(r.Context())
-
-	id, err := strconv.ParseInt(params.ByName("id"), 10, 64)
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
 	if err != nil || id < 1 {
 		return 0, errors.New("invalid id parameter")
 	}
@@ -109,6 +109,19 @@ func (a *appDependencies) readIDParam(r *http.Request) (int64, error) {
 	return id, nil
 }
 
+/* Same as readIDParam, but the /users/me routes have no {id} and resolve to the current user */
+func (a *appDependencies) readUserIDParam(r *http.Request) (int64, error) {
+	if r.PathValue("id") == "" {
+		user := a.ctxGetUser(r)
+		if user.IsAnon() {
+			return 0, errors.New("invalid id parameter")
+		}
+		return user.ID, nil
+	}
+
+	return a.readIDParam(r)
+}
+
 func (a *appDependencies) getSingleQueryParameters(queryParameters url.Values, key string, defaultValue string) string {
 	result := queryParameters.Get(key)
 
@@ -133,6 +146,160 @@ func (a *appDependencies) getSingleIntegerParameters(queryParameters url.Values,
 	return intValue
 }
 
+/* Collect a repeated or comma separated parameter, e.g. ?genre=fantasy&genre=horror or ?genre=fantasy,horror */
+func (a *appDependencies) getMultipleQueryParameters(queryParameters url.Values, key string) []string {
+	var results []string
+	for _, value := range queryParameters[key] {
+		for _, part := range strings.Split(value, ",") {
+			part = strings.TrimSpace(part)
+			if part != "" {
+				results = append(results, part)
+			}
+		}
+	}
+	return results
+}
+
+func (a *appDependencies) getSingleFloatParameters(queryParameters url.Values, key string, defaultValue float64, v *validator.Validator) float64 {
+	result := queryParameters.Get(key)
+	if result == "" {
+		return defaultValue
+	}
+
+	floatValue, err := strconv.ParseFloat(result, 64)
+	if err != nil {
+		v.AddError(key, "must be a number")
+		return defaultValue
+	}
+
+	return floatValue
+}
+
+/* Boolean parameter that is nil when absent so "not filtered" differs from false */
+func (a *appDependencies) getOptionalBoolParameters(queryParameters url.Values, key string, v *validator.Validator) *bool {
+	result := queryParameters.Get(key)
+	if result == "" {
+		return nil
+	}
+
+	boolValue, err := strconv.ParseBool(result)
+	if err != nil {
+		v.AddError(key, "must be true or false")
+		return nil
+	}
+
+	return &boolValue
+}
+
+/* RFC 8288 Link header pointing at the first, previous, next and last pages of a listing */
+func (a *appDependencies) paginationLinks(r *http.Request, metadata data.Metadata) http.Header {
+	headers := make(http.Header)
+
+	pageURL := func(key string, value string) string {
+		u := *r.URL
+		query := u.Query()
+		query.Del("page")
+		query.Del("cursor")
+		query.Set(key, value)
+		u.RawQuery = query.Encode()
+		return u.RequestURI()
+	}
+
+	var links []string
+	if metadata.TotalRecords != 0 {
+		links = append(links, fmt.Sprintf(`<%s>; rel="first"`, pageURL("page", strconv.Itoa(metadata.FirstPage))))
+		if metadata.PrevPage != 0 {
+			links = append(links, fmt.Sprintf(`<%s>; rel="prev"`, pageURL("page", strconv.Itoa(metadata.PrevPage))))
+		}
+	}
+	// cursors only walk forwards, so they are the next link once the client is in cursor mode
+	switch {
+	case metadata.NextCursor != "" && r.URL.Query().Get("cursor") != "":
+		links = append(links, fmt.Sprintf(`<%s>; rel="next"`, pageURL("cursor", metadata.NextCursor)))
+	case metadata.NextPage != 0:
+		links = append(links, fmt.Sprintf(`<%s>; rel="next"`, pageURL("page", strconv.Itoa(metadata.NextPage))))
+	}
+	if metadata.TotalRecords != 0 {
+		links = append(links, fmt.Sprintf(`<%s>; rel="last"`, pageURL("page", strconv.Itoa(metadata.LastPage))))
+	}
+
+	if len(links) > 0 {
+		headers.Set("Link", strings.Join(links, ", "))
+	}
+	return headers
+}
+
+/* JSON names of a struct's fields, following embedded structs */
+func jsonFieldNames(t reflect.Type) []string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		switch {
+		case name == "-" || !field.IsExported():
+			continue
+		case field.Anonymous && name == "":
+			names = append(names, jsonFieldNames(field.Type)...)
+		case name == "":
+			names = append(names, field.Name)
+		default:
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+/* Read ?fields=a,b and check each is a JSON field of the resource */
+func (a *appDependencies) getFieldsParameters(queryParameters url.Values, resource any, v *validator.Validator) []string {
+	fields := a.getMultipleQueryParameters(queryParameters, "fields")
+	permitted := jsonFieldNames(reflect.TypeOf(resource))
+	for _, field := range fields {
+		v.Check(validator.PermittedValue(field, permitted...), "fields", "must be one of "+strings.Join(permitted, ", "))
+	}
+	return fields
+}
+
+/* Read ?include=a,b and check each is a relation the resource can embed */
+func (a *appDependencies) getIncludeParameters(queryParameters url.Values, permitted []string, v *validator.Validator) []string {
+	include := a.getMultipleQueryParameters(queryParameters, "include")
+	for _, relation := range include {
+		v.Check(validator.PermittedValue(relation, permitted...), "include", "must be one of "+strings.Join(permitted, ", "))
+	}
+	return include
+}
+
+/* Turn a resource into its JSON object keeping only the requested fields, the id always stays */
+func (a *appDependencies) sparse(resource any, fields []string) (envelope, error) {
+	js, err := json.Marshal(resource)
+	if err != nil {
+		return nil, err
+	}
+
+	var object envelope
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+	err = dec.Decode(&object)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(fields) == 0 {
+		return object, nil
+	}
+
+	kept := envelope{"id": object["id"]}
+	for _, field := range fields {
+		if value, ok := object[field]; ok {
+			kept[field] = value
+		}
+	}
+	return kept, nil
+}
+
 func (a *appDependencies) background(fn func()) {
 	a.wg.Add(1)
 	go func() {
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"slices"
 
 	"github.com/thats-insane/awt-test3/internal/data"
 	"github.com/thats-insane/awt-test3/internal/validator"
@@ -14,7 +15,6 @@ func (a *appDependencies) createListHandler(w http.ResponseWriter, r *http.Reque
 	var incomingData struct {
 		Name   string `json:"name"`
 		Desc   string `json:"description"`
-		UserID int64  `json:"user_id"`
 		Status string `json:"status"`
 	}
 	err := a.readJSON(w, r, &incomingData)
@@ -23,10 +23,11 @@ func (a *appDependencies) createListHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	// the owner is always the authenticated user, never what the client sends
 	list := &data.List{
 		Name:   incomingData.Name,
 		Desc:   incomingData.Desc,
-		UserID: incomingData.UserID,
+		UserID: a.ctxGetUser(r).ID,
 		Status: incomingData.Status,
 	}
 
@@ -61,21 +62,32 @@ func (a *appDependencies) createListHandler(w http.ResponseWriter, r *http.Reque
 /* Select all lists */
 func (a *appDependencies) listListsHandler(w http.ResponseWriter, r *http.Request) {
 	var queryParametersData struct {
+		Fields  []string
+		Include []string
 		data.Filters
 	}
 	queryParameters := r.URL.Query()
 	queryParametersData.Filters.Sort = a.getSingleQueryParameters(queryParameters, "sort", "id")
-	queryParametersData.Filters.SortSafeList = []string{"id", "-id"}
+	queryParametersData.Filters.SortColumns = data.ListSortColumns
 	v := validator.New()
+	queryParametersData.Fields = a.getFieldsParameters(queryParameters, data.List{}, v)
+	queryParametersData.Include = a.getIncludeParameters(queryParameters, listIncludes, v)
 	queryParametersData.Filters.Page = a.getSingleIntegerParameters(queryParameters, "page", 1, v)
 	queryParametersData.Filters.PageSize = a.getSingleIntegerParameters(queryParameters, "page_size", 10, v)
+	queryParametersData.Filters.Cursor = a.getSingleQueryParameters(queryParameters, "cursor", "")
 	data.ValidateFilters(v, queryParametersData.Filters)
 	if !v.IsEmpty() {
 		a.failedValidation(w, r, v.Errors)
 		return
 	}
 
-	list, metadata, err := a.listModel.GetAll(queryParametersData.Filters)
+	lists, metadata, err := a.listModel.GetAll(queryParametersData.Filters)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	list, err := a.presentLists(lists, queryParametersData.Fields, queryParametersData.Include)
 	if err != nil {
 		a.serverErr(w, r, err)
 		return
@@ -86,7 +98,7 @@ func (a *appDependencies) listListsHandler(w http.ResponseWriter, r *http.Reques
 		"@metadata": metadata,
 	}
 
-	err = a.writeJSON(w, http.StatusOK, data, nil)
+	err = a.writeJSON(w, http.StatusOK, data, a.paginationLinks(r, metadata))
 	if err != nil {
 		a.serverErr(w, r, err)
 	}
@@ -94,19 +106,40 @@ func (a *appDependencies) listListsHandler(w http.ResponseWriter, r *http.Reques
 
 /* Add a new book to reading list */
 func (a *appDependencies) addBookToListHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := a.readIDParam(r)
+	if err != nil {
+		a.notFound(w, r)
+		return
+	}
+
+	list, err := a.listModel.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.notFound(w, r)
+		default:
+			a.serverErr(w, r, err)
+		}
+		return
+	}
+
+	if !a.canModify(r, list.UserID) {
+		a.notPermitted(w, r)
+		return
+	}
+
 	var incomingData struct {
-		ListID int64 `json:"list_id"`
 		BookID int64 `json:"book_id"`
 	}
 
-	err := a.readJSON(w, r, &incomingData)
+	err = a.readJSON(w, r, &incomingData)
 	if err != nil {
 		a.badRequest(w, r, err)
 		return
 	}
 
 	booklist := &data.BookList{
-		ListID: incomingData.ListID,
+		ListID: list.ID,
 		BookID: incomingData.BookID,
 	}
 	err = a.listModel.AddBook(booklist)
@@ -138,6 +171,15 @@ func (a *appDependencies) displayListHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	queryParameters := r.URL.Query()
+	v := validator.New()
+	fields := a.getFieldsParameters(queryParameters, data.List{}, v)
+	include := a.getIncludeParameters(queryParameters, listIncludes, v)
+	if !v.IsEmpty() {
+		a.failedValidation(w, r, v.Errors)
+		return
+	}
+
 	list, err := a.listModel.Get(id)
 	if err != nil {
 		switch {
@@ -149,8 +191,14 @@ func (a *appDependencies) displayListHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	presented, err := a.presentLists([]*data.List{list}, fields, include)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
 	data := envelope{
-		"list": list,
+		"list": presented[0],
 	}
 
 	err = a.writeJSON(w, http.StatusOK, data, nil)
@@ -179,10 +227,14 @@ func (a *appDependencies) updateListHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	if !a.canModify(r, list.UserID) {
+		a.notPermitted(w, r)
+		return
+	}
+
 	var incomingData struct {
 		Name   *string `json:"name"`
 		Desc   *string `json:"description"`
-		UserID *int64  `json:"user_id"`
 		Status *string `json:"status"`
 	}
 
@@ -192,6 +244,16 @@ func (a *appDependencies) updateListHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	if incomingData.Name != nil {
+		list.Name = *incomingData.Name
+	}
+	if incomingData.Desc != nil {
+		list.Desc = *incomingData.Desc
+	}
+	if incomingData.Status != nil {
+		list.Status = *incomingData.Status
+	}
+
 	v := validator.New()
 	data.ValidateList(v, list)
 	if !v.IsEmpty() {
@@ -224,7 +286,23 @@ func (a *appDependencies) deleteListHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	err = a.listModel.Delete(id)
+	list, err := a.listModel.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.notFound(w, r)
+		default:
+			a.serverErr(w, r, err)
+		}
+		return
+	}
+
+	if !a.canModify(r, list.UserID) {
+		a.notPermitted(w, r)
+		return
+	}
+
+	err = a.listModel.Delete(list.ID)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -253,7 +331,33 @@ func (a *appDependencies) deleteBookFromListHandler(w http.ResponseWriter, r *ht
 		return
 	}
 
-	err = a.listModel.DeleteBook(id)
+	list, err := a.listModel.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.notFound(w, r)
+		default:
+			a.serverErr(w, r, err)
+		}
+		return
+	}
+
+	if !a.canModify(r, list.UserID) {
+		a.notPermitted(w, r)
+		return
+	}
+
+	var incomingData struct {
+		BookID int64 `json:"book_id"`
+	}
+
+	err = a.readJSON(w, r, &incomingData)
+	if err != nil {
+		a.badRequest(w, r, err)
+		return
+	}
+
+	err = a.listModel.DeleteBook(list.ID, incomingData.BookID)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -273,3 +377,61 @@ func (a *appDependencies) deleteBookFromListHandler(w http.ResponseWriter, r *ht
 		a.serverErr(w, r, err)
 	}
 }
+
+/* Relations a list can embed with ?include= */
+var listIncludes = []string{"books", "owner"}
+
+/* Shape lists for a response, fetching each included relation for all of them in one query */
+func (a *appDependencies) presentLists(lists []*data.List, fields []string, include []string) ([]envelope, error) {
+	presented := make([]envelope, len(lists))
+	listIDs := make([]int64, len(lists))
+	userIDs := make([]int64, len(lists))
+	for i, list := range lists {
+		object, err := a.sparse(list, fields)
+		if err != nil {
+			return nil, err
+		}
+		presented[i] = object
+		listIDs[i] = list.ID
+		userIDs[i] = list.UserID
+	}
+
+	if slices.Contains(include, "books") {
+		bookIDs, err := a.listModel.GetBookIDs(listIDs)
+		if err != nil {
+			return nil, err
+		}
+
+		var allBookIDs []int64
+		for _, ids := range bookIDs {
+			allBookIDs = append(allBookIDs, ids...)
+		}
+		books, err := a.bookModel.GetMany(allBookIDs)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, list := range lists {
+			listBooks := []*data.Book{}
+			for _, id := range bookIDs[list.ID] {
+				if book, ok := books[id]; ok {
+					listBooks = append(listBooks, book)
+				}
+			}
+			presented[i]["books"] = listBooks
+		}
+	}
+
+	if slices.Contains(include, "owner") {
+		owners, err := a.userModel.GetProfiles(userIDs)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, list := range lists {
+			presented[i]["owner"] = owners[list.UserID]
+		}
+	}
+
+	return presented, nil
+}
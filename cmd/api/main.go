@@ -2,20 +2,26 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"database/sql"
 	"flag"
 	"log/slog"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
 	_ "github.com/lib/pq"
 	"github.com/thats-insane/awt-test3/internal/data"
 	"github.com/thats-insane/awt-test3/internal/mailer"
+	"github.com/thats-insane/awt-test3/internal/validator"
 )
 
 const appVersion = "1.0.0"
 
+/* Issuer and audience of the JWTs created in jwt auth mode */
+const jwtIssuer = "bookclub-api"
+
 type serverConfig struct {
 	port int
 	env  string
@@ -34,18 +40,34 @@ type serverConfig struct {
 		password string
 		sender   string
 	}
+	auth struct {
+		mode       string
+		jwtSecret  string
+		accessTTL  time.Duration
+		refreshTTL time.Duration
+	}
+	search struct {
+		language string
+	}
+	breachedPasswords string
+	cursorSecret      string
 }
 
 type appDependencies struct {
-	config      serverConfig
-	logger      *slog.Logger
-	userModel   data.UserModel
-	bookModel   data.BookModel
-	reviewModel data.ReviewModel
-	listModel   data.ListModel
-	tokenModel  data.TokenModel
-	mailer      mailer.Mailer
-	wg          sync.WaitGroup
+	config            serverConfig
+	logger            *slog.Logger
+	userModel         data.UserModel
+	bookModel         data.BookModel
+	reviewModel       data.ReviewModel
+	listModel         data.ListModel
+	tokenModel        data.TokenModel
+	permissionModel   data.PermissionModel
+	loginAttemptModel data.LoginAttemptModel
+	twoFactorModel    data.TwoFactorModel
+	apiKeyModel       data.APIKeyModel
+	oauthModel        data.OAuthModel
+	mailer            mailer.Mailer
+	wg                sync.WaitGroup
 }
 
 func openDB(settings serverConfig) (*sql.DB, error) {
@@ -82,10 +104,49 @@ func main() {
 	flag.StringVar(&settings.smtp.password, "smtp-password", "7a8cb475eeb545", "SMTP password")
 	flag.StringVar(&settings.smtp.sender, "smtp-sender", "Book Club Community <no-reply@bookclubcommunity.2021154337.net>", "SMTP sender")
 
+	flag.StringVar(&settings.auth.mode, "auth-mode", "token", "Authentication mode(token|jwt)")
+	flag.StringVar(&settings.auth.jwtSecret, "jwt-secret", "", "Secret used to sign JWTs when -auth-mode=jwt")
+	flag.DurationVar(&settings.auth.accessTTL, "access-token-ttl", 15*time.Minute, "Lifetime of authentication tokens")
+	flag.DurationVar(&settings.auth.refreshTTL, "refresh-token-ttl", 30*24*time.Hour, "Lifetime of refresh tokens")
+
+	flag.StringVar(&settings.search.language, "search-language", "english", "Default text search language for new books and searches")
+	flag.StringVar(&settings.cursorSecret, "cursor-secret", "", "Secret used to sign pagination cursors (random per process when empty)")
+	flag.StringVar(&settings.breachedPasswords, "breached-passwords", "", "File of breached password SHA-1 hashes (HASH or HASH:COUNT per line) to add to the bundled list")
+
 	flag.Parse()
 
 	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
 
+	switch {
+	case settings.auth.mode != "token" && settings.auth.mode != "jwt":
+		logger.Error("-auth-mode must be token or jwt")
+		os.Exit(1)
+	case settings.auth.mode == "jwt" && len(settings.auth.jwtSecret) < 32:
+		logger.Error("-jwt-secret must be at least 32 bytes when -auth-mode=jwt")
+		os.Exit(1)
+	case !validator.PermittedValue(settings.search.language, data.SearchLanguages...):
+		logger.Error("-search-language must be one of " + strings.Join(data.SearchLanguages, ", "))
+		os.Exit(1)
+	}
+
+	if settings.breachedPasswords != "" {
+		err := validator.LoadBreachedPasswords(settings.breachedPasswords)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+	}
+
+	data.CursorKey = []byte(settings.cursorSecret)
+	if settings.cursorSecret == "" {
+		data.CursorKey = make([]byte, 32)
+		_, err := rand.Read(data.CursorKey)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+	}
+
 	db, err := openDB(settings)
 	if err != nil {
 		logger.Error(err.Error())
@@ -97,11 +158,19 @@ func main() {
 	logger.Info("database connection pool established")
 
 	appInstance := &appDependencies{
-		config:     settings,
-		logger:     logger,
-		userModel:  data.UserModel{DB: db},
-		tokenModel: data.TokenModel{DB: db},
-		mailer:     mailer.New(settings.smtp.host, settings.smtp.port, settings.smtp.username, settings.smtp.password, settings.smtp.sender),
+		config:            settings,
+		logger:            logger,
+		userModel:         data.UserModel{DB: db},
+		bookModel:         data.BookModel{DB: db},
+		reviewModel:       data.ReviewModel{DB: db},
+		listModel:         data.ListModel{DB: db},
+		tokenModel:        data.TokenModel{DB: db},
+		permissionModel:   data.PermissionModel{DB: db},
+		loginAttemptModel: data.LoginAttemptModel{DB: db},
+		twoFactorModel:    data.TwoFactorModel{DB: db},
+		apiKeyModel:       data.APIKeyModel{DB: db},
+		oauthModel:        data.OAuthModel{DB: db},
+		mailer:            mailer.New(settings.smtp.host, settings.smtp.port, settings.smtp.username, settings.smtp.password, settings.smtp.sender),
 	}
 
 	err = appInstance.serve()
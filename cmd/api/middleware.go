@@ -6,11 +6,13 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"slices"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/thats-insane/awt-test3/internal/data"
+	"github.com/thats-insane/awt-test3/internal/jwt"
 	"github.com/thats-insane/awt-test3/internal/validator"
 	"golang.org/x/time/rate"
 )
@@ -91,11 +93,35 @@ func (a *appDependencies) authenticate(next http.Handler) http.Handler {
 			return
 		}
 		headerParts := strings.Split(authHeader, " ")
-		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
+		if len(headerParts) != 2 || (headerParts[0] != "Bearer" && headerParts[0] != "ApiKey") {
 			a.invalidAuthToken(w, r)
 			return
 		}
 		token := headerParts[1]
+
+		if headerParts[0] == "ApiKey" {
+			a.authenticateAPIKey(w, r, token, next)
+			return
+		}
+
+		if a.config.auth.mode == "jwt" && strings.Count(token, ".") == 2 {
+			claims, err := jwt.Parse(token, []byte(a.config.auth.jwtSecret), jwtIssuer, time.Now())
+			if err != nil {
+				a.invalidAuthToken(w, r)
+				return
+			}
+
+			// trust the signed claims instead of looking the user up on every request
+			user := &data.User{
+				ID:        claims.Subject,
+				Activated: claims.Activated,
+				Admin:     claims.Admin,
+			}
+			r = a.ctxSetClaimsUser(r, user)
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		v := validator.New()
 
 		data.ValidateTokenPlaintext(v, token)
@@ -104,7 +130,12 @@ func (a *appDependencies) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
+		var scopes []string
 		user, err := a.userModel.GetForToken(data.ScopeAuthentication, token)
+		if errors.Is(err, data.ErrRecordNotFound) {
+			// third-party apps use OAuth access tokens limited to the scopes the user consented to
+			user, scopes, err = a.oauthModel.GetForAccessToken(token)
+		}
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
@@ -117,11 +148,51 @@ func (a *appDependencies) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
+		err = a.tokenModel.UpdateLastUsed(data.HashTokenPlaintext(token))
+		if err != nil {
+			a.serverErr(w, r, err)
+			return
+		}
+
 		r = a.ctxSetUser(r, user)
+		r = a.ctxSetToken(r, token)
+		r = a.ctxSetScopes(r, scopes)
 		next.ServeHTTP(w, r)
 	})
 }
 
+/* Authenticate a user using an API key, the request is limited to the key's scopes */
+func (a *appDependencies) authenticateAPIKey(w http.ResponseWriter, r *http.Request, plaintext string, next http.Handler) {
+	v := validator.New()
+
+	data.ValidateAPIKeyPlaintext(v, plaintext)
+	if !v.IsEmpty() {
+		a.invalidAuthToken(w, r)
+		return
+	}
+
+	user, key, err := a.apiKeyModel.GetForKey(plaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.invalidAuthToken(w, r)
+		default:
+			a.serverErr(w, r, err)
+		}
+		return
+	}
+
+	err = a.apiKeyModel.UpdateLastUsed(key.ID)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	r = a.ctxSetUser(r, user)
+	r = a.ctxSetScopes(r, key.Scopes)
+	next.ServeHTTP(w, r)
+}
+
 /* Check if user is authenticated (not anonymous) */
 func (a *appDependencies) requireAuth(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -132,6 +203,12 @@ func (a *appDependencies) requireAuth(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
+		// scoped credentials only reach endpoints guarded by requirePermission, which clears the scopes
+		if a.ctxGetScopes(r) != nil {
+			a.notPermitted(w, r)
+			return
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
@@ -149,3 +226,57 @@ func (a *appDependencies) requireActivated(next http.HandlerFunc) http.HandlerFu
 	})
 	return a.requireAuth(fn)
 }
+
+/* Check if user is an admin */
+func (a *appDependencies) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := a.ctxGetUser(r)
+
+		if !user.Admin {
+			a.notPermitted(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+	return a.requireActivated(fn)
+}
+
+/* Check if the current user owns a record (admins can modify any record) */
+func (a *appDependencies) canModify(r *http.Request, ownerID int64) bool {
+	user := a.ctxGetUser(r)
+	return user.Admin || user.ID == ownerID
+}
+
+/* Check if user has been granted a specific permission */
+func (a *appDependencies) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		user := a.ctxGetUser(r)
+		permissions, err := a.permissionModel.GetAllForUser(user.ID)
+		if err != nil {
+			a.serverErr(w, r, err)
+			return
+		}
+
+		if !permissions.Include(code) {
+			a.notPermitted(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+	return a.requireScope(code, a.requireActivated(fn))
+}
+
+/* Check that scoped credentials (API keys) were granted this permission */
+func (a *appDependencies) requireScope(code string, next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scopes := a.ctxGetScopes(r)
+		if scopes != nil {
+			if !slices.Contains(scopes, code) {
+				a.notPermitted(w, r)
+				return
+			}
+			r = a.ctxSetScopes(r, nil)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/thats-insane/awt-test3/internal/data"
+	"github.com/thats-insane/awt-test3/internal/validator"
+)
+
+/* Parameters of an authorization request, see RFC 6749 section 4.1.1 and RFC 7636 section 4.3 */
+type authorizeRequest struct {
+	ResponseType        string `json:"response_type"`
+	ClientID            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+}
+
+/* Register a third-party application */
+func (a *appDependencies) createOAuthClientHandler(w http.ResponseWriter, r *http.Request) {
+	var incomingData struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Confidential bool     `json:"confidential"`
+	}
+	err := a.readJSON(w, r, &incomingData)
+	if err != nil {
+		a.badRequest(w, r, err)
+		return
+	}
+
+	client := &data.OAuthClient{
+		Name:         incomingData.Name,
+		RedirectURIs: incomingData.RedirectURIs,
+		Confidential: incomingData.Confidential,
+		UserID:       a.ctxGetUser(r).ID,
+	}
+
+	v := validator.New()
+	data.ValidateOAuthClient(v, client)
+	if !v.IsEmpty() {
+		a.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	err = a.oauthModel.InsertClient(client)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	data := envelope{
+		"client": client,
+	}
+
+	err = a.writeJSON(w, http.StatusCreated, data, nil)
+	if err != nil {
+		a.serverErr(w, r, err)
+	}
+}
+
+/* Check an authorization request, returns the client and requested scopes */
+func (a *appDependencies) checkAuthorizeRequest(w http.ResponseWriter, r *http.Request, req authorizeRequest) (*data.OAuthClient, []string, bool) {
+	v := validator.New()
+	v.Check(req.ResponseType == "code", "response_type", "must be code")
+	v.Check(req.ClientID != "", "client_id", "must be provided")
+	v.Check(req.CodeChallenge != "", "code_challenge", "must be provided")
+	v.Check(req.CodeChallengeMethod == "S256", "code_challenge_method", "must be S256")
+	if !v.IsEmpty() {
+		a.failedValidation(w, r, v.Errors)
+		return nil, nil, false
+	}
+
+	client, err := a.oauthModel.GetClient(req.ClientID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("client_id", "unknown client")
+			a.failedValidation(w, r, v.Errors)
+		default:
+			a.serverErr(w, r, err)
+		}
+		return nil, nil, false
+	}
+
+	// never send a code anywhere that wasn't registered
+	if !client.HasRedirectURI(req.RedirectURI) {
+		v.AddError("redirect_uri", "must match a redirect URI registered for the client")
+		a.failedValidation(w, r, v.Errors)
+		return nil, nil, false
+	}
+
+	// users can only delegate permissions they have themselves
+	permissions, err := a.permissionModel.GetAllForUser(a.ctxGetUser(r).ID)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return nil, nil, false
+	}
+
+	scopes := strings.Fields(req.Scope)
+	v.Check(len(scopes) > 0, "scope", "must be provided")
+	for _, scope := range scopes {
+		v.Check(permissions.Include(scope), "scope", "must only contain permissions you have been granted")
+	}
+	if !v.IsEmpty() {
+		a.failedValidation(w, r, v.Errors)
+		return nil, nil, false
+	}
+
+	return client, scopes, true
+}
+
+/* Show what a client is asking for so the user can consent */
+func (a *appDependencies) showAuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	queryParameters := r.URL.Query()
+	req := authorizeRequest{
+		ResponseType:        queryParameters.Get("response_type"),
+		ClientID:            queryParameters.Get("client_id"),
+		RedirectURI:         queryParameters.Get("redirect_uri"),
+		Scope:               queryParameters.Get("scope"),
+		State:               queryParameters.Get("state"),
+		CodeChallenge:       queryParameters.Get("code_challenge"),
+		CodeChallengeMethod: queryParameters.Get("code_challenge_method"),
+	}
+
+	client, scopes, ok := a.checkAuthorizeRequest(w, r, req)
+	if !ok {
+		return
+	}
+
+	data := envelope{
+		"client": envelope{
+			"client_id": client.ID,
+			"name":      client.Name,
+		},
+		"scopes":       scopes,
+		"redirect_uri": req.RedirectURI,
+		"state":        req.State,
+		"message":      "POST these parameters back to /oauth/authorize with approve set to true or false",
+	}
+
+	err := a.writeJSON(w, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErr(w, r, err)
+	}
+}
+
+/* Record the user's consent decision, returns where the user should be sent back to */
+func (a *appDependencies) approveAuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	var incomingData struct {
+		authorizeRequest
+		Approve bool `json:"approve"`
+	}
+	err := a.readJSON(w, r, &incomingData)
+	if err != nil {
+		a.badRequest(w, r, err)
+		return
+	}
+
+	client, scopes, ok := a.checkAuthorizeRequest(w, r, incomingData.authorizeRequest)
+	if !ok {
+		return
+	}
+
+	values := url.Values{}
+	if incomingData.State != "" {
+		values.Set("state", incomingData.State)
+	}
+
+	if incomingData.Approve {
+		code := &data.OAuthCode{
+			ClientID:      client.ID,
+			UserID:        a.ctxGetUser(r).ID,
+			RedirectURI:   incomingData.RedirectURI,
+			Scopes:        scopes,
+			CodeChallenge: incomingData.CodeChallenge,
+		}
+
+		err = a.oauthModel.NewCode(code, 10*time.Minute)
+		if err != nil {
+			a.serverErr(w, r, err)
+			return
+		}
+		values.Set("code", code.Plaintext)
+	} else {
+		values.Set("error", "access_denied")
+	}
+
+	redirect, err := url.Parse(incomingData.RedirectURI)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	// keep any query the client registered as part of its redirect URI
+	query := redirect.Query()
+	for key := range values {
+		query.Set(key, values.Get(key))
+	}
+	redirect.RawQuery = query.Encode()
+
+	data := envelope{
+		"redirect_to": redirect.String(),
+	}
+
+	err = a.writeJSON(w, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErr(w, r, err)
+	}
+}
+
+/* Exchange an authorization code and PKCE verifier for an access token */
+func (a *appDependencies) createOAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 16_000)
+	err := r.ParseForm()
+	if err != nil {
+		a.oauthErr(w, r, http.StatusBadRequest, "invalid_request", "the body must be form encoded")
+		return
+	}
+
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		a.oauthErr(w, r, http.StatusBadRequest, "unsupported_grant_type", "only authorization_code is supported")
+		return
+	}
+
+	// confidential clients may authenticate with HTTP Basic or in the body
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.PostForm.Get("client_id")
+		clientSecret = r.PostForm.Get("client_secret")
+	}
+
+	client, err := a.oauthModel.GetClient(clientID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.oauthErr(w, r, http.StatusUnauthorized, "invalid_client", "unknown client")
+		default:
+			a.serverErr(w, r, err)
+		}
+		return
+	}
+
+	if !client.SecretMatches(clientSecret) {
+		a.oauthErr(w, r, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return
+	}
+
+	verifier := r.PostForm.Get("code_verifier")
+	v := validator.New()
+	data.ValidateCodeVerifier(v, verifier)
+	if !v.IsEmpty() {
+		a.oauthErr(w, r, http.StatusBadRequest, "invalid_request", v.Errors["code_verifier"])
+		return
+	}
+
+	code, err := a.oauthModel.ConsumeCode(r.PostForm.Get("code"))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.oauthErr(w, r, http.StatusBadRequest, "invalid_grant", "invalid/expired authorization code")
+		default:
+			a.serverErr(w, r, err)
+		}
+		return
+	}
+
+	if code.ClientID != client.ID || code.RedirectURI != r.PostForm.Get("redirect_uri") || !code.VerifierMatches(verifier) {
+		a.oauthErr(w, r, http.StatusBadRequest, "invalid_grant", "the authorization code was not issued for this request")
+		return
+	}
+
+	ttl := time.Hour
+	token, err := a.oauthModel.NewAccessToken(code.UserID, client.ID, code.Scopes, ttl)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	data := envelope{
+		"access_token": token.Plaintext,
+		"token_type":   "Bearer",
+		"expires_in":   int(ttl.Seconds()),
+		"scope":        strings.Join(code.Scopes, " "),
+	}
+
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "no-store")
+	err = a.writeJSON(w, http.StatusOK, data, headers)
+	if err != nil {
+		a.serverErr(w, r, err)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thats-insane/awt-test3/internal/data"
+)
+
+func TestOAuthAuthorizationCodeFlow(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApp(db)
+	data.CursorKey = []byte("oauth-test-cursor-key")
+
+	ts := httptest.NewServer(app.routes())
+	defer ts.Close()
+
+	// an activated member who may browse the catalogue but not edit it
+	_, session := newTestUser(t, app, "reader", "books:read")
+
+	// register a public client that relies on PKCE
+	redirectURI := "https://client.example.com/callback"
+	status, body := doJSON(t, ts, http.MethodPost, "/api/v1/oauth/clients", session, "application/json",
+		`{"name": "Reading Tracker", "redirect_uris": ["`+redirectURI+`"]}`)
+	if status != http.StatusCreated {
+		t.Fatalf("register client: got status %d, body %v", status, body)
+	}
+	client := body["client"].(map[string]any)
+	clientID := client["client_id"].(string)
+	if _, ok := client["client_secret"]; ok {
+		t.Error("public client was given a secret")
+	}
+
+	verifier := strings.Repeat("verifier-", 6)
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	authorizeParams := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {clientID},
+		"redirect_uri":          {redirectURI},
+		"scope":                 {"books:read"},
+		"state":                 {"xyz"},
+		"code_challenge":        {challenge},
+		"code_challenge_method": {"S256"},
+	}
+
+	// the consent screen describes the request
+	status, body = doJSON(t, ts, http.MethodGet, "/oauth/authorize?"+authorizeParams.Encode(), session, "", "")
+	if status != http.StatusOK {
+		t.Fatalf("show consent: got status %d, body %v", status, body)
+	}
+	if scopes := body["scopes"].([]any); len(scopes) != 1 || scopes[0] != "books:read" {
+		t.Errorf("show consent: got scopes %v", scopes)
+	}
+
+	approve := func(scope string) (int, map[string]any) {
+		t.Helper()
+		return doJSON(t, ts, http.MethodPost, "/oauth/authorize", session, "application/json",
+			`{"response_type": "code", "client_id": "`+clientID+`", "redirect_uri": "`+redirectURI+`", "scope": "`+scope+`",
+			"state": "xyz", "code_challenge": "`+challenge+`", "code_challenge_method": "S256", "approve": true}`)
+	}
+
+	newCode := func() string {
+		t.Helper()
+		status, body := approve("books:read")
+		if status != http.StatusOK {
+			t.Fatalf("approve: got status %d, body %v", status, body)
+		}
+		redirect, err := url.Parse(body["redirect_to"].(string))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(redirect.String(), redirectURI+"?") || redirect.Query().Get("state") != "xyz" {
+			t.Errorf("approve: got redirect %q", redirect)
+		}
+		code := redirect.Query().Get("code")
+		if code == "" {
+			t.Fatalf("approve: no code in redirect %q", redirect)
+		}
+		return code
+	}
+
+	// users can't hand out permissions they don't have
+	status, body = approve("books:write")
+	if status != http.StatusUnprocessableEntity {
+		t.Errorf("approve books:write: got status %d, body %v", status, body)
+	}
+
+	exchange := func(code string, verifier string) (int, map[string]any) {
+		t.Helper()
+		form := url.Values{
+			"grant_type":    {"authorization_code"},
+			"client_id":     {clientID},
+			"redirect_uri":  {redirectURI},
+			"code":          {code},
+			"code_verifier": {verifier},
+		}
+		return doJSON(t, ts, http.MethodPost, "/oauth/token", "", "application/x-www-form-urlencoded", form.Encode())
+	}
+
+	// a wrong verifier is rejected (and burns the code)
+	status, body = exchange(newCode(), strings.Repeat("attacker-", 6))
+	if status != http.StatusBadRequest || body["error"] != "invalid_grant" {
+		t.Errorf("wrong verifier: got status %d, body %v", status, body)
+	}
+
+	code := newCode()
+	status, body = exchange(code, verifier)
+	if status != http.StatusOK {
+		t.Fatalf("exchange: got status %d, body %v", status, body)
+	}
+	if body["token_type"] != "Bearer" || body["scope"] != "books:read" {
+		t.Errorf("exchange: got body %v", body)
+	}
+	accessToken := body["access_token"].(string)
+
+	// codes are single use
+	status, body = exchange(code, verifier)
+	if status != http.StatusBadRequest || body["error"] != "invalid_grant" {
+		t.Errorf("reused code: got status %d, body %v", status, body)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"inside scope", http.MethodGet, "/api/v1/books", "", http.StatusOK},
+		{"outside scope", http.MethodPost, "/api/v1/books", `{"title": "Dune"}`, http.StatusForbidden},
+		{"requireAuth", http.MethodGet, "/api/v1/users/me/sessions", "", http.StatusForbidden},
+		{"requireActivated", http.MethodGet, "/api/v1/users/me", "", http.StatusForbidden},
+		{"register client", http.MethodPost, "/api/v1/oauth/clients", `{"name": "x", "redirect_uris": ["https://x.example.com"]}`, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := doJSON(t, ts, tt.method, tt.path, accessToken, "application/json", tt.body)
+			if status != tt.status {
+				t.Errorf("got status %d, want %d, body %v", status, tt.status, body)
+			}
+		})
+	}
+}
+
+func TestOAuthAccessTokensRevoked(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApp(db)
+	data.CursorKey = []byte("oauth-test-cursor-key")
+
+	ts := httptest.NewServer(app.routes())
+	defer ts.Close()
+
+	user, session := newTestUser(t, app, "reader", "books:read")
+	client := &data.OAuthClient{Name: "Reading Tracker", RedirectURIs: []string{"https://client.example.com/callback"}, UserID: user.ID}
+	err := app.oauthModel.InsertClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newAccessToken := func() string {
+		t.Helper()
+		token, err := app.oauthModel.NewAccessToken(user.ID, client.ID, []string{"books:read"}, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, body := doJSON(t, ts, http.MethodGet, "/api/v1/books", token.Plaintext, "", "")
+		if status != http.StatusOK {
+			t.Fatalf("fresh access token: got status %d, body %v", status, body)
+		}
+		return token.Plaintext
+	}
+
+	checkRevoked := func(name string, token string) {
+		t.Helper()
+		status, body := doJSON(t, ts, http.MethodGet, "/api/v1/books", token, "", "")
+		if status != http.StatusUnauthorized {
+			t.Errorf("%s: got status %d, want %d, body %v", name, status, http.StatusUnauthorized, body)
+		}
+	}
+
+	// log out everywhere
+	accessToken := newAccessToken()
+	status, body := doJSON(t, ts, http.MethodDelete, "/api/v1/tokens/authentication/all", session, "", "")
+	if status != http.StatusOK {
+		t.Fatalf("log out everywhere: got status %d, body %v", status, body)
+	}
+	checkRevoked("log out everywhere", accessToken)
+
+	// password reset
+	accessToken = newAccessToken()
+	reset, err := app.tokenModel.New(user.ID, time.Hour, data.ScopePasswordReset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, body = doJSON(t, ts, http.MethodPut, "/api/v1/users/password", "", "application/json",
+		`{"password": "n3w-B4ttery-h0rse-staple", "token": "`+reset.Plaintext+`"}`)
+	if status != http.StatusOK {
+		t.Fatalf("password reset: got status %d, body %v", status, body)
+	}
+	checkRevoked("password reset", accessToken)
+}
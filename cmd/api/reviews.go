@@ -4,30 +4,47 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"slices"
 	"time"
 
 	"github.com/thats-insane/awt-test3/internal/data"
 	"github.com/thats-insane/awt-test3/internal/validator"
 )
 
-/* Add a new review */
+/* Add a new review to the book in the path */
 func (a *appDependencies) createReviewHandler(w http.ResponseWriter, r *http.Request) {
+	bookID, err := a.readIDParam(r)
+	if err != nil {
+		a.notFound(w, r)
+		return
+	}
+
+	_, err = a.bookModel.Get(bookID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.notFound(w, r)
+		default:
+			a.serverErr(w, r, err)
+		}
+		return
+	}
+
 	var incomingData struct {
-		BookID    int64     `json:"book_id"`
-		UserID    int64     `json:"user_id"`
 		Rating    int64     `json:"rating"`
 		Desc      string    `json:"description"`
 		CreatedAt time.Time `json:"-"`
 	}
-	err := a.readJSON(w, r, &incomingData)
+	err = a.readJSON(w, r, &incomingData)
 	if err != nil {
 		a.badRequest(w, r, err)
 		return
 	}
 
+	// the author is always the authenticated user, never what the client sends
 	review := &data.Review{
-		BookID:    incomingData.BookID,
-		UserID:    incomingData.UserID,
+		BookID:    bookID,
+		UserID:    a.ctxGetUser(r).ID,
 		Rating:    incomingData.Rating,
 		Desc:      incomingData.Desc,
 		CreatedAt: incomingData.CreatedAt,
@@ -56,8 +73,6 @@ func (a *appDependencies) createReviewHandler(w http.ResponseWriter, r *http.Req
 		a.serverErr(w, r, err)
 		return
 	}
-
-	fmt.Fprintf(w, "%+v\n", incomingData)
 }
 
 /* Display a review */
@@ -68,6 +83,15 @@ func (a *appDependencies) displayReviewHandler(w http.ResponseWriter, r *http.Re
 		return
 	}
 
+	queryParameters := r.URL.Query()
+	v := validator.New()
+	fields := a.getFieldsParameters(queryParameters, data.Review{}, v)
+	include := a.getIncludeParameters(queryParameters, reviewIncludes, v)
+	if !v.IsEmpty() {
+		a.failedValidation(w, r, v.Errors)
+		return
+	}
+
 	review, err := a.reviewModel.Get(id)
 	if err != nil {
 		switch {
@@ -79,8 +103,14 @@ func (a *appDependencies) displayReviewHandler(w http.ResponseWriter, r *http.Re
 		return
 	}
 
+	presented, err := a.presentReviews([]*data.Review{review}, fields, include)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
 	data := envelope{
-		"review": review,
+		"review": presented[0],
 	}
 
 	err = a.writeJSON(w, http.StatusOK, data, nil)
@@ -109,9 +139,13 @@ func (a *appDependencies) updateReviewHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 
+	if !a.canModify(r, review.UserID) {
+		a.notPermitted(w, r)
+		return
+	}
+
 	var incomingData struct {
 		BookID    *int64     `json:"book_id"`
-		UserID    *int64     `json:"user_id"`
 		Rating    *int64     `json:"rating"`
 		Desc      *string    `json:"description"`
 		CreatedAt *time.Time `json:"-"`
@@ -125,9 +159,6 @@ func (a *appDependencies) updateReviewHandler(w http.ResponseWriter, r *http.Req
 	if incomingData.BookID != nil {
 		review.BookID = *incomingData.BookID
 	}
-	if incomingData.UserID != nil {
-		review.UserID = *incomingData.UserID
-	}
 	if incomingData.Rating != nil {
 		review.Rating = *incomingData.Rating
 	}
@@ -170,7 +201,23 @@ func (a *appDependencies) deleteReviewHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	err = a.reviewModel.Delete(id)
+	review, err := a.reviewModel.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.notFound(w, r)
+		default:
+			a.serverErr(w, r, err)
+		}
+		return
+	}
+
+	if !a.canModify(r, review.UserID) {
+		a.notPermitted(w, r)
+		return
+	}
+
+	err = a.reviewModel.Delete(review.ID)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -190,3 +237,211 @@ func (a *appDependencies) deleteReviewHandler(w http.ResponseWriter, r *http.Req
 		a.serverErr(w, r, err)
 	}
 }
+
+/* List the reviews of a book with a rating histogram */
+func (a *appDependencies) listBookReviewsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := a.readIDParam(r)
+	if err != nil {
+		a.notFound(w, r)
+		return
+	}
+
+	_, err = a.bookModel.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.notFound(w, r)
+		default:
+			a.serverErr(w, r, err)
+		}
+		return
+	}
+
+	var queryParametersData struct {
+		Fields  []string
+		Include []string
+		data.Filters
+	}
+	queryParameters := r.URL.Query()
+	queryParametersData.Filters.Sort = a.getSingleQueryParameters(queryParameters, "sort", "-created_at")
+	queryParametersData.Filters.SortColumns = data.ReviewSortColumns
+	v := validator.New()
+	queryParametersData.Fields = a.getFieldsParameters(queryParameters, data.Review{}, v)
+	queryParametersData.Include = a.getIncludeParameters(queryParameters, reviewIncludes, v)
+	queryParametersData.Filters.Page = a.getSingleIntegerParameters(queryParameters, "page", 1, v)
+	queryParametersData.Filters.PageSize = a.getSingleIntegerParameters(queryParameters, "page_size", 10, v)
+	queryParametersData.Filters.Cursor = a.getSingleQueryParameters(queryParameters, "cursor", "")
+	data.ValidateFilters(v, queryParametersData.Filters)
+	if !v.IsEmpty() {
+		a.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	reviews, metadata, err := a.reviewModel.GetForBook(id, queryParametersData.Filters)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	presented, err := a.presentReviews(reviews, queryParametersData.Fields, queryParametersData.Include)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	histogram, err := a.reviewModel.RatingHistogram(id)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	data := envelope{
+		"reviews":          presented,
+		"rating_histogram": histogram,
+		"@metadata":        metadata,
+	}
+
+	err = a.writeJSON(w, http.StatusOK, data, a.paginationLinks(r, metadata))
+	if err != nil {
+		a.serverErr(w, r, err)
+	}
+}
+
+/* List every review, the cursor lets sync jobs walk the whole collection */
+func (a *appDependencies) listReviewsHandler(w http.ResponseWriter, r *http.Request) {
+	var queryParametersData struct {
+		Fields  []string
+		Include []string
+		data.Filters
+	}
+	queryParameters := r.URL.Query()
+	queryParametersData.Filters.Sort = a.getSingleQueryParameters(queryParameters, "sort", "id")
+	queryParametersData.Filters.SortColumns = data.ReviewSortColumns
+	v := validator.New()
+	queryParametersData.Fields = a.getFieldsParameters(queryParameters, data.Review{}, v)
+	queryParametersData.Include = a.getIncludeParameters(queryParameters, reviewIncludes, v)
+	queryParametersData.Filters.Page = a.getSingleIntegerParameters(queryParameters, "page", 1, v)
+	queryParametersData.Filters.PageSize = a.getSingleIntegerParameters(queryParameters, "page_size", 10, v)
+	queryParametersData.Filters.Cursor = a.getSingleQueryParameters(queryParameters, "cursor", "")
+	data.ValidateFilters(v, queryParametersData.Filters)
+	if !v.IsEmpty() {
+		a.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	reviews, metadata, err := a.reviewModel.GetAll(queryParametersData.Filters)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	presented, err := a.presentReviews(reviews, queryParametersData.Fields, queryParametersData.Include)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	data := envelope{
+		"reviews":   presented,
+		"@metadata": metadata,
+	}
+
+	err = a.writeJSON(w, http.StatusOK, data, a.paginationLinks(r, metadata))
+	if err != nil {
+		a.serverErr(w, r, err)
+	}
+}
+
+/* Vote a review as helpful, or withdraw the vote on DELETE */
+func (a *appDependencies) voteReviewHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := a.readIDParam(r)
+	if err != nil {
+		a.notFound(w, r)
+		return
+	}
+
+	review, err := a.reviewModel.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.notFound(w, r)
+		default:
+			a.serverErr(w, r, err)
+		}
+		return
+	}
+
+	user := a.ctxGetUser(r)
+	if review.UserID == user.ID {
+		a.notPermitted(w, r)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		err = a.reviewModel.RemoveVote(review.ID, user.ID)
+	} else {
+		err = a.reviewModel.AddVote(review.ID, user.ID)
+	}
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	review, err = a.reviewModel.Get(review.ID)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	data := envelope{
+		"review": review,
+	}
+
+	err = a.writeJSON(w, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErr(w, r, err)
+	}
+}
+
+/* Relations a review can embed with ?include= */
+var reviewIncludes = []string{"book", "user"}
+
+/* Shape reviews for a response, fetching each included relation for all of them in one query */
+func (a *appDependencies) presentReviews(reviews []*data.Review, fields []string, include []string) ([]envelope, error) {
+	presented := make([]envelope, len(reviews))
+	bookIDs := make([]int64, len(reviews))
+	userIDs := make([]int64, len(reviews))
+	for i, review := range reviews {
+		object, err := a.sparse(review, fields)
+		if err != nil {
+			return nil, err
+		}
+		presented[i] = object
+		bookIDs[i] = review.BookID
+		userIDs[i] = review.UserID
+	}
+
+	if slices.Contains(include, "book") {
+		books, err := a.bookModel.GetMany(bookIDs)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, review := range reviews {
+			presented[i]["book"] = books[review.BookID]
+		}
+	}
+
+	if slices.Contains(include, "user") {
+		users, err := a.userModel.GetProfiles(userIDs)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, review := range reviews {
+			presented[i]["user"] = users[review.UserID]
+		}
+	}
+
+	return presented, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/thats-insane/awt-test3/internal/data"
+)
+
+/* Insert a book straight into the catalogue */
+func newTestBook(t *testing.T, app *appDependencies) *data.Book {
+	t.Helper()
+
+	book := &data.Book{
+		Title:    "The Left Hand of Darkness",
+		Author:   "Ursula K. Le Guin",
+		ISBN:     "9780441478125",
+		PubDate:  time.Date(1969, time.March, 1, 0, 0, 0, 0, time.UTC),
+		Genre:    "Science Fiction",
+		Desc:     "An envoy visits the planet Gethen.",
+		Language: "english",
+	}
+	err := app.bookModel.Insert(book)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return book
+}
+
+func TestReviewsMaintainBookRating(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApp(db)
+
+	ts := httptest.NewServer(app.routes())
+	defer ts.Close()
+
+	book := newTestBook(t, app)
+	bookPath := fmt.Sprintf("/api/v1/books/%d", book.ID)
+	_, alice := newTestUser(t, app, "alice", "books:read")
+	_, bob := newTestUser(t, app, "bob", "books:read")
+
+	checkRating := func(avgRating float64, reviewCount float64) {
+		t.Helper()
+		status, body := doJSON(t, ts, http.MethodGet, bookPath, alice, "", "")
+		if status != http.StatusOK {
+			t.Fatalf("get book: got status %d, body %v", status, body)
+		}
+		got := body["book"].(map[string]any)
+		if got["avg_rating"] != avgRating || got["review_count"] != reviewCount {
+			t.Errorf("got avg_rating %v and review_count %v, want %v and %v", got["avg_rating"], got["review_count"], avgRating, reviewCount)
+		}
+	}
+
+	checkRating(0, 0)
+
+	status, body := doJSON(t, ts, http.MethodPost, bookPath+"/reviews", alice, "application/json", `{"rating": 5, "description": "Brilliant"}`)
+	if status != http.StatusCreated {
+		t.Fatalf("create review: got status %d, body %v", status, body)
+	}
+	review := body["review"].(map[string]any)
+	if review["id"] == float64(0) || review["created_at"] == "0001-01-01T00:00:00Z" {
+		t.Errorf("create review: id and created_at should come back from the database, got %v", review)
+	}
+	checkRating(5, 1)
+
+	status, body = doJSON(t, ts, http.MethodPost, bookPath+"/reviews", bob, "application/json", `{"rating": 2, "description": "Slow going"}`)
+	if status != http.StatusCreated {
+		t.Fatalf("create second review: got status %d, body %v", status, body)
+	}
+	checkRating(3.5, 2)
+
+	status, body = doJSON(t, ts, http.MethodDelete, fmt.Sprintf("/api/v1/reviews/%v", review["id"]), alice, "", "")
+	if status != http.StatusOK {
+		t.Fatalf("delete review: got status %d, body %v", status, body)
+	}
+	checkRating(2, 1)
+}
+
+func TestReviewVotesAndListings(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApp(db)
+	data.CursorKey = []byte("reviews-test-cursor-key")
+
+	ts := httptest.NewServer(app.routes())
+	defer ts.Close()
+
+	book := newTestBook(t, app)
+	bookPath := fmt.Sprintf("/api/v1/books/%d", book.ID)
+	alice, aliceToken := newTestUser(t, app, "alice", "books:read")
+	_, bobToken := newTestUser(t, app, "bob", "books:read")
+	_, carolToken := newTestUser(t, app, "carol", "books:read")
+
+	createReview := func(token string, rating int) float64 {
+		t.Helper()
+		status, body := doJSON(t, ts, http.MethodPost, bookPath+"/reviews", token, "application/json",
+			fmt.Sprintf(`{"rating": %d, "description": "%d stars"}`, rating, rating))
+		if status != http.StatusCreated {
+			t.Fatalf("create review: got status %d, body %v", status, body)
+		}
+		return body["review"].(map[string]any)["id"].(float64)
+	}
+	aliceReview := createReview(aliceToken, 4)
+	bobReview := createReview(bobToken, 2)
+
+	vote := func(method string, token string, reviewID float64, want int) {
+		t.Helper()
+		status, body := doJSON(t, ts, method, fmt.Sprintf("/api/v1/reviews/%v/helpful", reviewID), token, "", "")
+		if status != want {
+			t.Errorf("%s vote: got status %d, want %d, body %v", method, status, want, body)
+		}
+	}
+	vote(http.MethodPut, bobToken, aliceReview, http.StatusOK)
+	vote(http.MethodPut, carolToken, aliceReview, http.StatusOK)
+	vote(http.MethodPut, carolToken, bobReview, http.StatusOK)
+	vote(http.MethodDelete, carolToken, bobReview, http.StatusOK)
+	vote(http.MethodPut, aliceToken, aliceReview, http.StatusForbidden)
+
+	status, body := doJSON(t, ts, http.MethodGet, bookPath+"/reviews?sort=-helpful_count", aliceToken, "", "")
+	if status != http.StatusOK {
+		t.Fatalf("list book reviews: got status %d, body %v", status, body)
+	}
+	reviews := body["reviews"].([]any)
+	if len(reviews) != 2 {
+		t.Fatalf("list book reviews: got %d reviews, want 2", len(reviews))
+	}
+	first := reviews[0].(map[string]any)
+	second := reviews[1].(map[string]any)
+	if first["id"] != aliceReview || first["helpful_count"] != float64(2) || second["helpful_count"] != float64(0) {
+		t.Errorf("list book reviews: got %v", reviews)
+	}
+	histogram := body["rating_histogram"].(map[string]any)
+	want := map[string]any{"1": float64(0), "2": float64(1), "3": float64(0), "4": float64(1), "5": float64(0)}
+	if fmt.Sprint(histogram) != fmt.Sprint(want) {
+		t.Errorf("rating histogram: got %v, want %v", histogram, want)
+	}
+
+	status, body = doJSON(t, ts, http.MethodGet, fmt.Sprintf("/api/v1/users/%d/reviews", alice.ID), bobToken, "", "")
+	if status != http.StatusOK {
+		t.Fatalf("list user reviews: got status %d, body %v", status, body)
+	}
+	if len(body) != 1 || body["review0"].(map[string]any)["bookID"] != float64(book.ID) {
+		t.Errorf("list user reviews: got %v", body)
+	}
+}
@@ -2,46 +2,105 @@ package main
 
 import (
 	"net/http"
-
-	"github.com/julienschmidt/httprouter"
+	"strings"
 )
 
-/*
-Some routes are commented due to an error (':id' in new path conflicts with existing wildcard ':id' in existing prefix). Not sure what the proper fix would be other than making each endpoint unique, which goes against the instructions
-*/
+/* Register every endpoint on a ServeMux using Go 1.22 method and wildcard patterns */
+func (a *appDependencies) router() *http.ServeMux {
+	router := http.NewServeMux()
+
+	router.HandleFunc("GET /api/v1/healthcheck", a.healthCheckHandler)
+	router.HandleFunc("GET /oauth/authorize", a.requireActivated(a.showAuthorizeHandler))
+
+	router.HandleFunc("GET /api/v1/books", a.requirePermission("books:read", a.listBooksHandler))
+	router.HandleFunc("GET /api/v1/books/{id}", a.requirePermission("books:read", a.displayBookHandler))
+	router.HandleFunc("GET /api/v1/books/search", a.requirePermission("books:read", a.searchBooksHandler))
+	router.HandleFunc("GET /api/v1/books/autocomplete", a.requirePermission("books:read", a.autocompleteBooksHandler))
+	router.HandleFunc("GET /api/v1/books/{id}/reviews", a.requirePermission("books:read", a.listBookReviewsHandler))
+	router.HandleFunc("GET /api/v1/reviews", a.requirePermission("books:read", a.listReviewsHandler))
+	router.HandleFunc("GET /api/v1/reviews/{id}", a.requirePermission("books:read", a.displayReviewHandler))
+	router.HandleFunc("GET /api/v1/lists", a.requireActivated(a.listListsHandler))
+	router.HandleFunc("GET /api/v1/lists/{id}", a.requireActivated(a.displayListHandler))
+	router.HandleFunc("GET /api/v1/users/me", a.requireActivated(a.displayUserHandler))
+	router.HandleFunc("GET /api/v1/users/{id}", a.requireActivated(a.displayUserHandler))
+	router.HandleFunc("GET /api/v1/users/{id}/lists", a.requireActivated(a.displayUserListsHandler))
+	router.HandleFunc("GET /api/v1/users/{id}/reviews", a.requireActivated(a.displayUserReviewsHandler))
+	router.HandleFunc("GET /api/v1/users/me/sessions", a.requireAuth(a.listSessionsHandler))
+	router.HandleFunc("GET /api/v1/users/me/api-keys", a.requireAuth(a.listAPIKeysHandler))
+
+	router.HandleFunc("POST /api/v1/users", a.createUserHandler)
+	router.HandleFunc("POST /api/v1/books", a.requirePermission("books:write", a.createBookHandler))
+	router.HandleFunc("POST /api/v1/books/{id}/reviews", a.requireActivated(a.createReviewHandler))
+	router.HandleFunc("POST /api/v1/lists", a.requireActivated(a.createListHandler))
+	router.HandleFunc("POST /api/v1/lists/{id}/books", a.requireActivated(a.addBookToListHandler))
+	router.HandleFunc("POST /api/v1/tokens/activation", a.createActivationTokenHandler)
+	router.HandleFunc("POST /api/v1/tokens/authentication", a.createAuthTokenHandler)
+	router.HandleFunc("POST /api/v1/tokens/refresh", a.refreshAuthTokenHandler)
+	router.HandleFunc("POST /api/v1/tokens/two-factor", a.createTwoFactorAuthTokenHandler)
+	router.HandleFunc("POST /api/v1/tokens/password-reset", a.createPasswordResetTokenHandler)
+	router.HandleFunc("POST /api/v1/users/me/2fa", a.requireActivated(a.enrollTwoFactorHandler))
+	router.HandleFunc("POST /api/v1/users/me/api-keys", a.requireActivated(a.createAPIKeyHandler))
+	router.HandleFunc("POST /api/v1/oauth/clients", a.requireActivated(a.createOAuthClientHandler))
+	router.HandleFunc("POST /oauth/authorize", a.requireActivated(a.approveAuthorizeHandler))
+	router.HandleFunc("POST /oauth/token", a.createOAuthTokenHandler)
+
+	router.HandleFunc("PUT /api/v1/users/activated", a.activateUserHandler)
+	router.HandleFunc("PUT /api/v1/users/password", a.updateUserPasswordHandler)
+	router.HandleFunc("PUT /api/v1/users/email", a.confirmEmailChangeHandler)
+	router.HandleFunc("PUT /api/v1/users/me/2fa", a.requireActivated(a.confirmTwoFactorHandler))
+	router.HandleFunc("PUT /api/v1/books/{id}", a.requirePermission("books:write", a.updateBookHandler))
+	router.HandleFunc("PUT /api/v1/lists/{id}", a.requireActivated(a.updateListHandler))
+	router.HandleFunc("PUT /api/v1/reviews/{id}", a.requireActivated(a.updateReviewHandler))
+	router.HandleFunc("PUT /api/v1/reviews/{id}/helpful", a.requireActivated(a.voteReviewHandler))
+
+	router.HandleFunc("PATCH /api/v1/users/me", a.requireAuth(a.updateCurrentUserHandler))
+
+	router.HandleFunc("DELETE /api/v1/users/me", a.requireAuth(a.deleteCurrentUserHandler))
+	router.HandleFunc("DELETE /api/v1/users/me/2fa", a.requireActivated(a.disableTwoFactorHandler))
+	router.HandleFunc("DELETE /api/v1/users/me/api-keys/{id}", a.requireActivated(a.deleteAPIKeyHandler))
+	router.HandleFunc("DELETE /api/v1/books/{id}", a.requirePermission("books:write", a.deleteBookHandler))
+	router.HandleFunc("DELETE /api/v1/lists/{id}", a.requireActivated(a.deleteListHandler))
+	router.HandleFunc("DELETE /api/v1/lists/{id}/books", a.requireActivated(a.deleteBookFromListHandler))
+	router.HandleFunc("DELETE /api/v1/reviews/{id}", a.requireActivated(a.deleteReviewHandler))
+	router.HandleFunc("DELETE /api/v1/reviews/{id}/helpful", a.requireActivated(a.voteReviewHandler))
+	router.HandleFunc("DELETE /api/v1/tokens/authentication", a.requireAuth(a.deleteAuthTokenHandler))
+	router.HandleFunc("DELETE /api/v1/tokens/authentication/all", a.requireAuth(a.deleteAllAuthTokensHandler))
+	router.HandleFunc("DELETE /api/v1/admin/users/{id}/lockout", a.requireAdmin(a.unlockUserHandler))
+
+	return router
+}
+
 func (a *appDependencies) routes() http.Handler {
-	router := httprouter.New()
-
-	router.NotFound = http.HandlerFunc(a.notFound)
-	router.MethodNotAllowed = http.HandlerFunc(a.notAllowed)
-	router.HandlerFunc(http.MethodGet, "/api/v1/healthcheck", a.healthCheckHandler)
-
-	router.HandlerFunc(http.MethodGet, "/api/v1/books", a.requireActivated(a.listBooksHandler))
-	router.HandlerFunc(http.MethodGet, "/api/v1/books/:id", a.requireActivated(a.displayBookHandler))
-	// router.HandlerFunc(http.MethodGet, "/api/v1/books/search", a.requireActivated(a.searchBooksHandler))
-	router.HandlerFunc(http.MethodGet, "/api/v1/lists", a.requireActivated(a.listListsHandler))
-	router.HandlerFunc(http.MethodGet, "/api/v1/lists/:id", a.requireActivated(a.displayListHandler))
-	// router.HandlerFunc(http.MethodGet, "/api/v1/books/:id/reviews", a.requireActivated(a.displayReviewHandler))
-	router.HandlerFunc(http.MethodGet, "/api/v1/users/:id", a.requireActivated(a.displayUserHandler))
-	router.HandlerFunc(http.MethodGet, "/api/v1/users/:id/lists", a.requireActivated(a.displayUserListsHandler))
-	router.HandlerFunc(http.MethodGet, "/api/v1/users/:id/reviews", a.requireActivated(a.displayUserReviewsHandler))
-
-	router.HandlerFunc(http.MethodPost, "/api/v1/users", a.createUserHandler)
-	router.HandlerFunc(http.MethodPost, "/api/v1/books", a.requireActivated(a.createBookHandler))
-	router.HandlerFunc(http.MethodPost, "/api/v1/lists", a.requireActivated(a.createListHandler))
-	router.HandlerFunc(http.MethodPost, "/api/v1/lists/:id/books", a.requireActivated(a.addBookToListHandler))
-	router.HandlerFunc(http.MethodPost, "/api/vi/books/:id/reviews", a.requireActivated(a.createReviewHandler))
-	router.HandlerFunc(http.MethodPost, "/api/v1/tokens/authentication", a.createAuthTokenHandler)
-
-	router.HandlerFunc(http.MethodPut, "/api/v1/users/activated", a.activateUserHandler)
-	router.HandlerFunc(http.MethodPut, "/api/v1/books/:id", a.requireActivated(a.updateBookHandler))
-	router.HandlerFunc(http.MethodPut, "/api/v1/lists/:id", a.requireActivated(a.updateListHandler))
-	router.HandlerFunc(http.MethodPut, "/api/v1/reviews/:id", a.requireActivated(a.updateReviewHandler))
-
-	router.HandlerFunc(http.MethodDelete, "/api/v1/books/:id", a.requireActivated(a.deleteBookHandler))
-	router.HandlerFunc(http.MethodDelete, "/api/v1/lists/:id", a.requireActivated(a.deleteListHandler))
-	router.HandlerFunc(http.MethodDelete, "/api/v1/lists/:id/books", a.requireActivated(a.deleteBookFromListHandler))
-	router.HandlerFunc(http.MethodDelete, "/api/v1/reviews/:id", a.requireActivated(a.deleteReviewHandler))
-
-	return a.recoverPanic(a.rateLimit(a.authenticate(router)))
+	return a.recoverPanic(a.rateLimit(a.authenticate(a.jsonRouteErrors(a.router()))))
+}
+
+/* Answer unmatched paths and methods with our JSON errors instead of the ServeMux plain text ones */
+func (a *appDependencies) jsonRouteErrors(router *http.ServeMux) http.Handler {
+	methods := []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := router.Handler(r)
+		if pattern != "" {
+			router.ServeHTTP(w, r)
+			return
+		}
+
+		// the path may still exist under another method
+		var allowed []string
+		for _, method := range methods {
+			probe := *r
+			probe.Method = method
+			_, pattern := router.Handler(&probe)
+			if pattern != "" {
+				allowed = append(allowed, method)
+			}
+		}
+
+		if len(allowed) > 0 {
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			a.notAllowed(w, r)
+			return
+		}
+		a.notFound(w, r)
+	})
 }
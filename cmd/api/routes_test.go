@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRoutesResolve(t *testing.T) {
+	router := (&appDependencies{}).router()
+
+	tests := []struct {
+		method  string
+		path    string
+		pattern string
+	}{
+		{http.MethodGet, "/api/v1/healthcheck", "GET /api/v1/healthcheck"},
+		{http.MethodGet, "/oauth/authorize", "GET /oauth/authorize"},
+		{http.MethodGet, "/api/v1/books", "GET /api/v1/books"},
+		{http.MethodGet, "/api/v1/books/7", "GET /api/v1/books/{id}"},
+		{http.MethodGet, "/api/v1/books/search", "GET /api/v1/books/search"},
+		{http.MethodGet, "/api/v1/books/autocomplete", "GET /api/v1/books/autocomplete"},
+		{http.MethodGet, "/api/v1/books/7/reviews", "GET /api/v1/books/{id}/reviews"},
+		{http.MethodGet, "/api/v1/reviews", "GET /api/v1/reviews"},
+		{http.MethodGet, "/api/v1/reviews/7", "GET /api/v1/reviews/{id}"},
+		{http.MethodGet, "/api/v1/lists", "GET /api/v1/lists"},
+		{http.MethodGet, "/api/v1/lists/7", "GET /api/v1/lists/{id}"},
+		{http.MethodGet, "/api/v1/users/me", "GET /api/v1/users/me"},
+		{http.MethodGet, "/api/v1/users/7", "GET /api/v1/users/{id}"},
+		{http.MethodGet, "/api/v1/users/7/lists", "GET /api/v1/users/{id}/lists"},
+		{http.MethodGet, "/api/v1/users/7/reviews", "GET /api/v1/users/{id}/reviews"},
+		{http.MethodGet, "/api/v1/users/me/sessions", "GET /api/v1/users/me/sessions"},
+		{http.MethodGet, "/api/v1/users/me/api-keys", "GET /api/v1/users/me/api-keys"},
+
+		{http.MethodPost, "/api/v1/users", "POST /api/v1/users"},
+		{http.MethodPost, "/api/v1/books", "POST /api/v1/books"},
+		{http.MethodPost, "/api/v1/books/7/reviews", "POST /api/v1/books/{id}/reviews"},
+		{http.MethodPost, "/api/v1/lists", "POST /api/v1/lists"},
+		{http.MethodPost, "/api/v1/lists/7/books", "POST /api/v1/lists/{id}/books"},
+		{http.MethodPost, "/api/v1/tokens/activation", "POST /api/v1/tokens/activation"},
+		{http.MethodPost, "/api/v1/tokens/authentication", "POST /api/v1/tokens/authentication"},
+		{http.MethodPost, "/api/v1/tokens/refresh", "POST /api/v1/tokens/refresh"},
+		{http.MethodPost, "/api/v1/tokens/two-factor", "POST /api/v1/tokens/two-factor"},
+		{http.MethodPost, "/api/v1/tokens/password-reset", "POST /api/v1/tokens/password-reset"},
+		{http.MethodPost, "/api/v1/users/me/2fa", "POST /api/v1/users/me/2fa"},
+		{http.MethodPost, "/api/v1/users/me/api-keys", "POST /api/v1/users/me/api-keys"},
+		{http.MethodPost, "/api/v1/oauth/clients", "POST /api/v1/oauth/clients"},
+		{http.MethodPost, "/oauth/authorize", "POST /oauth/authorize"},
+		{http.MethodPost, "/oauth/token", "POST /oauth/token"},
+
+		{http.MethodPut, "/api/v1/users/activated", "PUT /api/v1/users/activated"},
+		{http.MethodPut, "/api/v1/users/password", "PUT /api/v1/users/password"},
+		{http.MethodPut, "/api/v1/users/email", "PUT /api/v1/users/email"},
+		{http.MethodPut, "/api/v1/users/me/2fa", "PUT /api/v1/users/me/2fa"},
+		{http.MethodPut, "/api/v1/books/7", "PUT /api/v1/books/{id}"},
+		{http.MethodPut, "/api/v1/lists/7", "PUT /api/v1/lists/{id}"},
+		{http.MethodPut, "/api/v1/reviews/7", "PUT /api/v1/reviews/{id}"},
+		{http.MethodPut, "/api/v1/reviews/7/helpful", "PUT /api/v1/reviews/{id}/helpful"},
+
+		{http.MethodPatch, "/api/v1/users/me", "PATCH /api/v1/users/me"},
+
+		{http.MethodDelete, "/api/v1/users/me", "DELETE /api/v1/users/me"},
+		{http.MethodDelete, "/api/v1/users/me/2fa", "DELETE /api/v1/users/me/2fa"},
+		{http.MethodDelete, "/api/v1/users/me/api-keys/7", "DELETE /api/v1/users/me/api-keys/{id}"},
+		{http.MethodDelete, "/api/v1/books/7", "DELETE /api/v1/books/{id}"},
+		{http.MethodDelete, "/api/v1/lists/7", "DELETE /api/v1/lists/{id}"},
+		{http.MethodDelete, "/api/v1/lists/7/books", "DELETE /api/v1/lists/{id}/books"},
+		{http.MethodDelete, "/api/v1/reviews/7", "DELETE /api/v1/reviews/{id}"},
+		{http.MethodDelete, "/api/v1/reviews/7/helpful", "DELETE /api/v1/reviews/{id}/helpful"},
+		{http.MethodDelete, "/api/v1/tokens/authentication", "DELETE /api/v1/tokens/authentication"},
+		{http.MethodDelete, "/api/v1/tokens/authentication/all", "DELETE /api/v1/tokens/authentication/all"},
+		{http.MethodDelete, "/api/v1/admin/users/7/lockout", "DELETE /api/v1/admin/users/{id}/lockout"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+
+			_, pattern := router.Handler(r)
+			if pattern != tt.pattern {
+				t.Errorf("got pattern %q, want %q", pattern, tt.pattern)
+			}
+		})
+	}
+}
+
+func TestRoutesJSONErrors(t *testing.T) {
+	handler := (&appDependencies{}).routes()
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+		allow  string
+	}{
+		{http.MethodGet, "/api/v1/nothing-here", http.StatusNotFound, ""},
+		{http.MethodPost, "/api/vi/books/7/reviews", http.StatusNotFound, ""},
+		{http.MethodPatch, "/api/v1/books/7", http.StatusMethodNotAllowed, "GET, PUT, DELETE"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+
+			if w.Code != tt.status {
+				t.Errorf("got status %d, want %d", w.Code, tt.status)
+			}
+			if got := w.Header().Get("Content-Type"); got != "application/json" {
+				t.Errorf("got Content-Type %q, want application/json", got)
+			}
+			if got := w.Header().Get("Allow"); got != tt.allow {
+				t.Errorf("got Allow %q, want %q", got, tt.allow)
+			}
+		})
+	}
+}
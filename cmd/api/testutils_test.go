@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thats-insane/awt-test3/internal/data"
+)
+
+/*
+Open the database named by BOOKCLUB_TEST_DB_DSN (a postgres:// URL) and run every up migration
+into a throwaway schema that is dropped when the test ends. Tests are skipped when it isn't set.
+*/
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	dsn := os.Getenv("BOOKCLUB_TEST_DB_DSN")
+	if dsn == "" {
+		t.Skip("BOOKCLUB_TEST_DB_DSN not set, skipping database test")
+	}
+
+	suffix := make([]byte, 4)
+	_, err := rand.Read(suffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := "test_" + hex.EncodeToString(suffix)
+
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+
+	_, err = admin.Exec("CREATE SCHEMA " + schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cleanup, err := sql.Open("postgres", dsn)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer cleanup.Close()
+		_, err = cleanup.Exec("DROP SCHEMA " + schema + " CASCADE")
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	// every connection in the pool starts in the throwaway schema
+	parsed, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := parsed.Query()
+	query.Set("search_path", schema+",public")
+	parsed.RawQuery = query.Encode()
+
+	db, err := sql.Open("postgres", parsed.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	// the users table needs citext, which the migrations expect to be installed already
+	_, err = db.Exec("CREATE EXTENSION IF NOT EXISTS citext")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	migrations, err := filepath.Glob(filepath.Join("..", "..", "migrations", "*.up.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(migrations)
+
+	for _, migration := range migrations {
+		statements, err := os.ReadFile(migration)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(string(statements))
+		if err != nil {
+			t.Fatalf("%s: %v", filepath.Base(migration), err)
+		}
+	}
+
+	return db
+}
+
+/* Application wired to a test database, with the rate limiter off */
+func newTestApp(db *sql.DB) *appDependencies {
+	var settings serverConfig
+	settings.env = "testing"
+	settings.auth.mode = "token"
+	settings.auth.accessTTL = 15 * time.Minute
+	settings.auth.refreshTTL = time.Hour
+	settings.search.language = "english"
+
+	return &appDependencies{
+		config:            settings,
+		logger:            slog.New(slog.NewTextHandler(io.Discard, nil)),
+		userModel:         data.UserModel{DB: db},
+		bookModel:         data.BookModel{DB: db},
+		reviewModel:       data.ReviewModel{DB: db},
+		listModel:         data.ListModel{DB: db},
+		tokenModel:        data.TokenModel{DB: db},
+		permissionModel:   data.PermissionModel{DB: db},
+		loginAttemptModel: data.LoginAttemptModel{DB: db},
+		twoFactorModel:    data.TwoFactorModel{DB: db},
+		apiKeyModel:       data.APIKeyModel{DB: db},
+		oauthModel:        data.OAuthModel{DB: db},
+	}
+}
+
+/* Send a request to the test server and decode the JSON response */
+func doJSON(t *testing.T, ts *httptest.Server, method string, path string, token string, contentType string, body string) (int, map[string]any) {
+	t.Helper()
+
+	r, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+
+	res, err := ts.Client().Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	raw, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded map[string]any
+	if len(bytes.TrimSpace(raw)) > 0 {
+		err = json.Unmarshal(raw, &decoded)
+		if err != nil {
+			t.Fatalf("%s %s: invalid JSON response %q", method, path, raw)
+		}
+	}
+	return res.StatusCode, decoded
+}
+
+/* Insert an activated user with the given permissions and return them with a session token */
+func newTestUser(t *testing.T, app *appDependencies, username string, permissions ...string) (*data.User, string) {
+	t.Helper()
+
+	user := &data.User{Username: username, Email: username + "@example.com", Activated: true}
+	err := user.Password.Set("c0rrect-H0rse-b4ttery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = app.userModel.Insert(user, permissions...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session, err := app.tokenModel.New(user.ID, time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user, session.Plaintext
+}
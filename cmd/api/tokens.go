@@ -6,6 +6,8 @@ import (
 	"time"
 
 	"github.com/thats-insane/awt-test3/internal/data"
+	"github.com/thats-insane/awt-test3/internal/jwt"
+	"github.com/thats-insane/awt-test3/internal/totp"
 	"github.com/thats-insane/awt-test3/internal/validator"
 )
 
@@ -40,6 +42,17 @@ func (a *appDependencies) createAuthTokenHandler(w http.ResponseWriter, r *http.
 		return
 	}
 
+	attempt, err := a.loginAttemptModel.Get(user.ID)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	if attempt.IsLocked(time.Now()) {
+		a.accountLocked(w, r, time.Until(*attempt.LockedUntil))
+		return
+	}
+
 	match, err := user.Password.Matches(incomingData.Password)
 	if err != nil {
 		a.serverErr(w, r, err)
@@ -47,11 +60,286 @@ func (a *appDependencies) createAuthTokenHandler(w http.ResponseWriter, r *http.
 	}
 
 	if !match {
+		a.recordFailedLogin(user)
 		a.invalidCredentials(w, r)
 		return
 	}
 
-	token, err := a.tokenModel.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	a.rehashPassword(user, incomingData.Password)
+
+	twoFactor, err := a.twoFactorModel.Get(user.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	// with 2FA on, the password only earns a short lived token to exchange along with a code
+	if twoFactor != nil && twoFactor.Confirmed {
+		token, err := a.tokenModel.New(user.ID, 5*time.Minute, data.ScopeTwoFactorPending)
+		if err != nil {
+			a.serverErr(w, r, err)
+			return
+		}
+
+		data := envelope{
+			"twoFactorToken": token,
+			"message":        "send this token with a code from your authenticator app to POST /api/v1/tokens/two-factor",
+		}
+
+		err = a.writeJSON(w, http.StatusOK, data, nil)
+		if err != nil {
+			a.serverErr(w, r, err)
+		}
+		return
+	}
+
+	a.completeLogin(w, r, user, attempt)
+}
+
+/* Exchange a pending 2FA token and a TOTP or recovery code for authentication tokens */
+func (a *appDependencies) createTwoFactorAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var incomingData struct {
+		Plaintext    string `json:"token"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	err := a.readJSON(w, r, &incomingData)
+	if err != nil {
+		a.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidateTokenPlaintext(v, incomingData.Plaintext)
+	data.ValidateTwoFactorCode(v, incomingData.Code, incomingData.RecoveryCode)
+	if !v.IsEmpty() {
+		a.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	user, err := a.userModel.GetForToken(data.ScopeTwoFactorPending, incomingData.Plaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid/expired two-factor token")
+			a.failedValidation(w, r, v.Errors)
+		default:
+			a.serverErr(w, r, err)
+		}
+		return
+	}
+
+	attempt, err := a.loginAttemptModel.Get(user.ID)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	if attempt.IsLocked(time.Now()) {
+		a.accountLocked(w, r, time.Until(*attempt.LockedUntil))
+		return
+	}
+
+	twoFactor, err := a.twoFactorModel.Get(user.ID)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	if incomingData.Code != "" {
+		step, ok := totp.Validate(twoFactor.Secret, incomingData.Code, time.Now())
+		if ok {
+			err = a.twoFactorModel.UseStep(user.ID, step)
+		} else {
+			err = data.ErrRecordNotFound
+		}
+	} else {
+		err = a.twoFactorModel.UseRecoveryCode(user.ID, incomingData.RecoveryCode)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound), errors.Is(err, data.ErrCodeReused):
+			// wrong codes count towards the lockout the same as wrong passwords
+			a.recordFailedLogin(user)
+			v.AddError("code", "invalid two-factor code")
+			a.failedValidation(w, r, v.Errors)
+		default:
+			a.serverErr(w, r, err)
+		}
+		return
+	}
+
+	err = a.tokenModel.DeleteAllForUser(data.ScopeTwoFactorPending, user.ID)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	a.completeLogin(w, r, user, attempt)
+}
+
+/* Clear failed logins and send back a new authentication and refresh token */
+func (a *appDependencies) completeLogin(w http.ResponseWriter, r *http.Request, user *data.User, attempt *data.LoginAttempt) {
+	if attempt.FailedCount > 0 {
+		err := a.loginAttemptModel.Reset(user.ID)
+		if err != nil {
+			a.serverErr(w, r, err)
+			return
+		}
+	}
+
+	family, err := data.NewTokenFamily()
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	token, refreshToken, err := a.newTokenPair(user, family)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	data := envelope{
+		"authenticationToken": token,
+		"refreshToken":        refreshToken,
+	}
+
+	err = a.writeJSON(w, http.StatusCreated, data, nil)
+	if err != nil {
+		a.serverErr(w, r, err)
+	}
+}
+
+/* Count a failed login and warn the account owner by email when it gets locked */
+func (a *appDependencies) recordFailedLogin(user *data.User) {
+	attempt, err := a.loginAttemptModel.RecordFailure(user.ID)
+	if err != nil {
+		a.logger.Error(err.Error())
+		return
+	}
+
+	// one warning per hour is enough, even if the lockout keeps growing
+	if attempt.LockedUntil == nil || (attempt.NotifiedAt != nil && time.Since(*attempt.NotifiedAt) < time.Hour) {
+		return
+	}
+
+	err = a.loginAttemptModel.MarkNotified(user.ID)
+	if err != nil {
+		a.logger.Error(err.Error())
+		return
+	}
+
+	a.background(func() {
+		data := map[string]any{
+			"username":    user.Username,
+			"failedCount": attempt.FailedCount,
+			"lockedUntil": attempt.LockedUntil.UTC().Format(time.RFC1123),
+		}
+		err := a.mailer.Send(user.Email, "login_suspicious.tmpl", data)
+		if err != nil {
+			a.logger.Error(err.Error())
+		}
+	})
+}
+
+/* Upgrade a password hash made with an old scheme or parameters; failures never block the login */
+func (a *appDependencies) rehashPassword(user *data.User, plaintext string) {
+	if !user.Password.NeedsRehash() {
+		return
+	}
+
+	err := user.Password.Set(plaintext)
+	if err != nil {
+		a.logger.Error(err.Error())
+		return
+	}
+
+	err = a.userModel.Update(user)
+	if err != nil && !errors.Is(err, data.ErrEditConflict) {
+		a.logger.Error(err.Error())
+	}
+}
+
+/* Issue an authentication token and a refresh token that share a token family */
+func (a *appDependencies) newTokenPair(user *data.User, family []byte) (*data.Token, *data.Token, error) {
+	var token *data.Token
+	var err error
+	if a.config.auth.mode == "jwt" {
+		token, err = a.newJWT(user, a.config.auth.accessTTL)
+	} else {
+		token, err = a.tokenModel.NewInFamily(user.ID, a.config.auth.accessTTL, data.ScopeAuthentication, family)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	refreshToken, err := a.tokenModel.NewInFamily(user.ID, a.config.auth.refreshTTL, data.ScopeRefresh, family)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return token, refreshToken, nil
+}
+
+/* Swap a refresh token for a new authentication and refresh token */
+func (a *appDependencies) refreshAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var incomingData struct {
+		Plaintext string `json:"token"`
+	}
+
+	err := a.readJSON(w, r, &incomingData)
+	if err != nil {
+		a.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidateTokenPlaintext(v, incomingData.Plaintext)
+	if !v.IsEmpty() {
+		a.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	refreshToken, err := a.tokenModel.GetRefresh(incomingData.Plaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid/expired refresh token")
+			a.failedValidation(w, r, v.Errors)
+		default:
+			a.serverErr(w, r, err)
+		}
+		return
+	}
+
+	// each refresh token works once, a second use means it leaked so the whole login is revoked
+	err = a.tokenModel.MarkUsed(refreshToken.Hash)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTokenReused):
+			a.logger.Warn("refresh token reuse detected, revoking token family", "user_id", refreshToken.UserID)
+			err = a.tokenModel.DeleteFamily(refreshToken.Family)
+			if err != nil {
+				a.serverErr(w, r, err)
+				return
+			}
+			v.AddError("token", "refresh token has already been used, please log in again")
+			a.failedValidation(w, r, v.Errors)
+		default:
+			a.serverErr(w, r, err)
+		}
+		return
+	}
+
+	user, err := a.userModel.Get(refreshToken.UserID)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	token, newRefreshToken, err := a.newTokenPair(user, refreshToken.Family)
 	if err != nil {
 		a.serverErr(w, r, err)
 		return
@@ -59,6 +347,7 @@ func (a *appDependencies) createAuthTokenHandler(w http.ResponseWriter, r *http.
 
 	data := envelope{
 		"authenticationToken": token,
+		"refreshToken":        newRefreshToken,
 	}
 
 	err = a.writeJSON(w, http.StatusCreated, data, nil)
@@ -66,3 +355,231 @@ func (a *appDependencies) createAuthTokenHandler(w http.ResponseWriter, r *http.
 		a.serverErr(w, r, err)
 	}
 }
+
+/* Send a password reset token to a user's email */
+func (a *appDependencies) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var incomingData struct {
+		Email string `json:"email"`
+	}
+
+	err := a.readJSON(w, r, &incomingData)
+	if err != nil {
+		a.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidateEmail(v, incomingData.Email)
+	if !v.IsEmpty() {
+		a.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	user, err := a.userModel.GetByEmail(incomingData.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("email", "no matching email address found")
+			a.failedValidation(w, r, v.Errors)
+		default:
+			a.serverErr(w, r, err)
+		}
+		return
+	}
+
+	if !user.Activated {
+		v.AddError("email", "user account must be activated")
+		a.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	token, err := a.tokenModel.New(user.ID, 45*time.Minute, data.ScopePasswordReset)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	a.background(func() {
+		data := map[string]any{
+			"passwordResetToken": token.Plaintext,
+		}
+		err = a.mailer.Send(user.Email, "token_password_reset.tmpl", data)
+		if err != nil {
+			a.logger.Error(err.Error())
+		}
+	})
+
+	data := envelope{
+		"message": "an email will be sent to you containing password reset instructions",
+	}
+
+	err = a.writeJSON(w, http.StatusAccepted, data, nil)
+	if err != nil {
+		a.serverErr(w, r, err)
+	}
+}
+
+/* Send a new activation token to a user that has not activated their account */
+func (a *appDependencies) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var incomingData struct {
+		Email string `json:"email"`
+	}
+
+	err := a.readJSON(w, r, &incomingData)
+	if err != nil {
+		a.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidateEmail(v, incomingData.Email)
+	if !v.IsEmpty() {
+		a.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	user, err := a.userModel.GetByEmail(incomingData.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("email", "no matching email address found")
+			a.failedValidation(w, r, v.Errors)
+		default:
+			a.serverErr(w, r, err)
+		}
+		return
+	}
+
+	if user.Activated {
+		v.AddError("email", "user has already been activated")
+		a.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	// only the most recent activation token should work
+	err = a.tokenModel.DeleteAllForUser(data.ScopeActivation, user.ID)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	token, err := a.tokenModel.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	a.background(func() {
+		data := map[string]any{
+			"activationToken": token.Plaintext,
+		}
+		err = a.mailer.Send(user.Email, "token_activation.tmpl", data)
+		if err != nil {
+			a.logger.Error(err.Error())
+		}
+	})
+
+	data := envelope{
+		"message": "an email will be sent to you containing activation instructions",
+	}
+
+	err = a.writeJSON(w, http.StatusAccepted, data, nil)
+	if err != nil {
+		a.serverErr(w, r, err)
+	}
+}
+
+/* Issue a signed JWT for a user, used instead of database tokens when -auth-mode=jwt */
+func (a *appDependencies) newJWT(user *data.User, ttl time.Duration) (*data.Token, error) {
+	now := time.Now()
+	claims := jwt.Claims{
+		Subject:   user.ID,
+		Issuer:    jwtIssuer,
+		Audience:  jwtIssuer,
+		IssuedAt:  now.Unix(),
+		NotBefore: now.Unix(),
+		Expiry:    now.Add(ttl).Unix(),
+		Activated: user.Activated,
+		Admin:     user.Admin,
+	}
+
+	plaintext, err := jwt.Sign(claims, []byte(a.config.auth.jwtSecret))
+	if err != nil {
+		return nil, err
+	}
+
+	token := &data.Token{
+		Plaintext: plaintext,
+		UserID:    user.ID,
+		CreatedAt: now,
+		Expiry:    time.Unix(claims.Expiry, 0),
+		Scope:     data.ScopeAuthentication,
+	}
+	return token, nil
+}
+
+/* Revoke the authentication token used for this request (logout) */
+func (a *appDependencies) deleteAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if a.config.auth.mode == "jwt" {
+		a.statelessToken(w, r)
+		return
+	}
+
+	err := a.tokenModel.DeleteByHash(data.HashTokenPlaintext(a.ctxGetToken(r)))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.invalidAuthToken(w, r)
+		default:
+			a.serverErr(w, r, err)
+		}
+		return
+	}
+
+	data := envelope{
+		"message": "you have been logged out",
+	}
+
+	err = a.writeJSON(w, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErr(w, r, err)
+	}
+}
+
+/* Revoke every authentication token for the current user (logout everywhere) */
+func (a *appDependencies) deleteAllAuthTokensHandler(w http.ResponseWriter, r *http.Request) {
+	if a.config.auth.mode == "jwt" {
+		a.statelessToken(w, r)
+		return
+	}
+
+	user := a.ctxGetUser(r)
+
+	err := a.tokenModel.DeleteAllForUser(data.ScopeAuthentication, user.ID)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	err = a.tokenModel.DeleteAllForUser(data.ScopeRefresh, user.ID)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	// apps the user authorised lose access too
+	err = a.tokenModel.DeleteAllForUser(data.ScopeOAuthAccess, user.ID)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	data := envelope{
+		"message": "you have been logged out of all sessions",
+	}
+
+	err = a.writeJSON(w, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErr(w, r, err)
+	}
+}
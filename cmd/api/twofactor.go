@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/thats-insane/awt-test3/internal/data"
+	"github.com/thats-insane/awt-test3/internal/totp"
+	"github.com/thats-insane/awt-test3/internal/validator"
+)
+
+/* Issuer name shown in authenticator apps */
+const totpIssuer = "Book Club"
+
+/* Start 2FA enrollment, returns the secret to add to an authenticator app */
+func (a *appDependencies) enrollTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := a.ctxGetFullUser(r)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	twoFactor, err := a.twoFactorModel.Get(user.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	if twoFactor != nil && twoFactor.Confirmed {
+		v := validator.New()
+		v.AddError("two_factor", "two-factor authentication is already enabled")
+		a.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	err = a.twoFactorModel.Enroll(user.ID, secret)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	data := envelope{
+		"secret":      secret,
+		"otpauth_uri": totp.URI(totpIssuer, user.Email, secret),
+		"message":     "add the secret to your authenticator app, then confirm with PUT /api/v1/users/me/2fa",
+	}
+
+	err = a.writeJSON(w, http.StatusCreated, data, nil)
+	if err != nil {
+		a.serverErr(w, r, err)
+	}
+}
+
+/* Confirm 2FA enrollment with a code, returns the recovery codes */
+func (a *appDependencies) confirmTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user := a.ctxGetUser(r)
+
+	var incomingData struct {
+		Code string `json:"code"`
+	}
+	err := a.readJSON(w, r, &incomingData)
+	if err != nil {
+		a.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidateTwoFactorCode(v, incomingData.Code, "")
+	if !v.IsEmpty() {
+		a.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	twoFactor, err := a.twoFactorModel.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("two_factor", "start enrollment with POST /api/v1/users/me/2fa first")
+			a.failedValidation(w, r, v.Errors)
+		default:
+			a.serverErr(w, r, err)
+		}
+		return
+	}
+
+	if twoFactor.Confirmed {
+		v.AddError("two_factor", "two-factor authentication is already enabled")
+		a.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	step, ok := totp.Validate(twoFactor.Secret, incomingData.Code, time.Now())
+	if !ok {
+		v.AddError("code", "invalid two-factor code")
+		a.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	err = a.twoFactorModel.Confirm(user.ID, step)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	codes, err := a.twoFactorModel.NewRecoveryCodes(user.ID)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	data := envelope{
+		"recovery_codes": codes,
+		"message":        "two-factor authentication is enabled, store these recovery codes somewhere safe as they will not be shown again",
+	}
+
+	err = a.writeJSON(w, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErr(w, r, err)
+	}
+}
+
+/* Turn off 2FA, a current code is required */
+func (a *appDependencies) disableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user := a.ctxGetUser(r)
+
+	var incomingData struct {
+		Code string `json:"code"`
+	}
+	err := a.readJSON(w, r, &incomingData)
+	if err != nil {
+		a.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidateTwoFactorCode(v, incomingData.Code, "")
+	if !v.IsEmpty() {
+		a.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	twoFactor, err := a.twoFactorModel.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.notFound(w, r)
+		default:
+			a.serverErr(w, r, err)
+		}
+		return
+	}
+
+	step, ok := totp.Validate(twoFactor.Secret, incomingData.Code, time.Now())
+	if ok {
+		err = a.twoFactorModel.UseStep(user.ID, step)
+	} else {
+		err = data.ErrRecordNotFound
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound), errors.Is(err, data.ErrCodeReused):
+			v.AddError("code", "invalid two-factor code")
+			a.failedValidation(w, r, v.Errors)
+		default:
+			a.serverErr(w, r, err)
+		}
+		return
+	}
+
+	err = a.twoFactorModel.Delete(user.ID)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	data := envelope{
+		"message": "two-factor authentication is disabled",
+	}
+
+	err = a.writeJSON(w, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErr(w, r, err)
+	}
+}
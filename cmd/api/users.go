@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"net/http"
@@ -42,7 +43,8 @@ func (a *appDependencies) createUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	err = a.userModel.Insert(user)
+	// new members can browse the catalogue, curators are granted books:write separately
+	err = a.userModel.Insert(user, "books:read")
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrDuplicateEmail):
@@ -135,9 +137,9 @@ func (a *appDependencies) activateUserHandler(w http.ResponseWriter, r *http.Req
 	}
 }
 
-/* Grab user from database and display */
+/* Grab user from database and display ("me" displays the current user) */
 func (a *appDependencies) displayUserHandler(w http.ResponseWriter, r *http.Request) {
-	id, err := a.readIDParam(r)
+	id, err := a.readUserIDParam(r)
 	if err != nil {
 		a.notFound(w, r)
 		return
@@ -226,7 +228,7 @@ func (a *appDependencies) displayUserReviewsHandler(w http.ResponseWriter, r *ht
 	}
 
 	// iterate over all the user reviews and match them to the book
-	var data map[string]any
+	data := envelope{}
 	for i, review := range userreviews {
 		reviews := envelope{
 			"bookID": review.BookID,
@@ -240,3 +242,472 @@ func (a *appDependencies) displayUserReviewsHandler(w http.ResponseWriter, r *ht
 		return
 	}
 }
+
+/* Reset a user's password using their password reset token */
+func (a *appDependencies) updateUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var incomingData struct {
+		Password  string `json:"password"`
+		Plaintext string `json:"token"`
+	}
+	err := a.readJSON(w, r, &incomingData)
+	if err != nil {
+		a.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidatePasswordPlaintext(v, incomingData.Password)
+	data.ValidateTokenPlaintext(v, incomingData.Plaintext)
+	if !v.IsEmpty() {
+		a.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	user, err := a.userModel.GetForToken(data.ScopePasswordReset, incomingData.Plaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid/expired password reset token")
+			a.failedValidation(w, r, v.Errors)
+		default:
+			a.serverErr(w, r, err)
+		}
+		return
+	}
+
+	data.ValidateNewPassword(v, incomingData.Password, user.Username, user.Email)
+	if !v.IsEmpty() {
+		a.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	err = user.Password.Set(incomingData.Password)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	err = a.userModel.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			a.editConflict(w, r)
+		default:
+			a.serverErr(w, r, err)
+		}
+		return
+	}
+
+	// the reset token is single use, and any existing sessions may belong to whoever had the old password
+	err = a.tokenModel.DeleteAllForUser(data.ScopePasswordReset, user.ID)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	err = a.tokenModel.DeleteAllForUser(data.ScopeAuthentication, user.ID)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	err = a.tokenModel.DeleteAllForUser(data.ScopeRefresh, user.ID)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	// apps the user authorised lose access too
+	err = a.tokenModel.DeleteAllForUser(data.ScopeOAuthAccess, user.ID)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	err = a.loginAttemptModel.Reset(user.ID)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	data := envelope{
+		"message": "your password was successfully reset",
+	}
+
+	err = a.writeJSON(w, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErr(w, r, err)
+	}
+}
+
+/* Display the current user's active sessions */
+func (a *appDependencies) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if a.config.auth.mode == "jwt" {
+		a.statelessToken(w, r)
+		return
+	}
+
+	user := a.ctxGetUser(r)
+
+	tokens, err := a.tokenModel.GetAllForUser(data.ScopeAuthentication, user.ID)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	current := data.HashTokenPlaintext(a.ctxGetToken(r))
+	sessions := []envelope{}
+	for _, token := range tokens {
+		sessions = append(sessions, envelope{
+			"created_at":   token.CreatedAt,
+			"expiry":       token.Expiry,
+			"last_used_at": token.LastUsedAt,
+			"current":      bytes.Equal(token.Hash, current),
+		})
+	}
+
+	data := envelope{
+		"sessions": sessions,
+	}
+
+	err = a.writeJSON(w, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErr(w, r, err)
+	}
+}
+
+/* Update the current user's username, email or password */
+func (a *appDependencies) updateCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := a.ctxGetFullUser(r)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	var incomingData struct {
+		Username        *string `json:"username"`
+		Email           *string `json:"email"`
+		Password        *string `json:"password"`
+		CurrentPassword string  `json:"current_password"`
+	}
+	err = a.readJSON(w, r, &incomingData)
+	if err != nil {
+		a.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if incomingData.Username != nil {
+		user.Username = *incomingData.Username
+	}
+
+	// a new email is only applied once the user proves they own it
+	var pendingEmail string
+	if incomingData.Email != nil && *incomingData.Email != user.Email {
+		pendingEmail = *incomingData.Email
+		data.ValidateEmail(v, pendingEmail)
+	}
+
+	if incomingData.Password != nil {
+		// guessing the current password counts towards the same lockout as logging in
+		attempt, err := a.loginAttemptModel.Get(user.ID)
+		if err != nil {
+			a.serverErr(w, r, err)
+			return
+		}
+
+		if attempt.IsLocked(time.Now()) {
+			a.accountLocked(w, r, time.Until(*attempt.LockedUntil))
+			return
+		}
+
+		match, err := user.Password.Matches(incomingData.CurrentPassword)
+		if err != nil {
+			a.serverErr(w, r, err)
+			return
+		}
+		if !match {
+			a.recordFailedLogin(user)
+			v.AddError("current_password", "must match your current password")
+			a.failedValidation(w, r, v.Errors)
+			return
+		}
+
+		err = user.Password.Set(*incomingData.Password)
+		if err != nil {
+			a.serverErr(w, r, err)
+			return
+		}
+	}
+
+	data.ValidateUser(v, user)
+	if !v.IsEmpty() {
+		a.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	if pendingEmail != "" {
+		_, err = a.userModel.GetByEmail(pendingEmail)
+		switch {
+		case err == nil:
+			v.AddError("email", "a user with this email already exists")
+			a.failedValidation(w, r, v.Errors)
+			return
+		case !errors.Is(err, data.ErrRecordNotFound):
+			a.serverErr(w, r, err)
+			return
+		}
+	}
+
+	err = a.userModel.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			a.editConflict(w, r)
+		default:
+			a.serverErr(w, r, err)
+		}
+		return
+	}
+
+	// a new password logs out every other session, like a password reset does
+	if incomingData.Password != nil {
+		err = a.tokenModel.DeleteOtherSessions(user.ID, data.HashTokenPlaintext(a.ctxGetToken(r)))
+		if err != nil {
+			a.serverErr(w, r, err)
+			return
+		}
+
+		err = a.loginAttemptModel.Reset(user.ID)
+		if err != nil {
+			a.serverErr(w, r, err)
+			return
+		}
+	}
+
+	message := "your account was successfully updated"
+	if pendingEmail != "" {
+		err = a.userModel.SetPendingEmail(user.ID, pendingEmail)
+		if err != nil {
+			a.serverErr(w, r, err)
+			return
+		}
+
+		err = a.tokenModel.DeleteAllForUser(data.ScopeEmailChange, user.ID)
+		if err != nil {
+			a.serverErr(w, r, err)
+			return
+		}
+
+		token, err := a.tokenModel.New(user.ID, 24*time.Hour, data.ScopeEmailChange)
+		if err != nil {
+			a.serverErr(w, r, err)
+			return
+		}
+
+		a.background(func() {
+			data := map[string]any{
+				"emailChangeToken": token.Plaintext,
+			}
+			err := a.mailer.Send(pendingEmail, "token_email_change.tmpl", data)
+			if err != nil {
+				a.logger.Error(err.Error())
+			}
+		})
+
+		message = "your account was successfully updated, an email has been sent to your new address to confirm the change"
+	}
+
+	data := envelope{
+		"user":    user,
+		"message": message,
+	}
+
+	err = a.writeJSON(w, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErr(w, r, err)
+	}
+}
+
+/* Apply a pending email change using the token sent to the new address */
+func (a *appDependencies) confirmEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var incomingData struct {
+		Plaintext string `json:"token"`
+	}
+	err := a.readJSON(w, r, &incomingData)
+	if err != nil {
+		a.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidateTokenPlaintext(v, incomingData.Plaintext)
+	if !v.IsEmpty() {
+		a.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	user, err := a.userModel.GetForToken(data.ScopeEmailChange, incomingData.Plaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid/expired email change token")
+			a.failedValidation(w, r, v.Errors)
+		default:
+			a.serverErr(w, r, err)
+		}
+		return
+	}
+
+	email, err := a.userModel.GetPendingEmail(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid/expired email change token")
+			a.failedValidation(w, r, v.Errors)
+		default:
+			a.serverErr(w, r, err)
+		}
+		return
+	}
+
+	user.Email = email
+	err = a.userModel.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email already exists")
+			a.failedValidation(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			a.editConflict(w, r)
+		default:
+			a.serverErr(w, r, err)
+		}
+		return
+	}
+
+	err = a.userModel.DeletePendingEmail(user.ID)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	err = a.tokenModel.DeleteAllForUser(data.ScopeEmailChange, user.ID)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	data := envelope{
+		"user": user,
+	}
+
+	err = a.writeJSON(w, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErr(w, r, err)
+	}
+}
+
+/* Delete the current user's account */
+func (a *appDependencies) deleteCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := a.ctxGetFullUser(r)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	var incomingData struct {
+		Password string `json:"password"`
+		Mode     string `json:"mode"`
+	}
+	err = a.readJSON(w, r, &incomingData)
+	if err != nil {
+		a.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(validator.PermittedValue(incomingData.Mode, data.DeleteModeAnonymise, data.DeleteModeHard), "mode", "must be anonymise or delete")
+	if !v.IsEmpty() {
+		a.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	match, err := user.Password.Matches(incomingData.Password)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+	if !match {
+		a.invalidCredentials(w, r)
+		return
+	}
+
+	err = a.userModel.Delete(user.ID, incomingData.Mode)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.notFound(w, r)
+		default:
+			a.serverErr(w, r, err)
+		}
+		return
+	}
+
+	anonymise := incomingData.Mode == data.DeleteModeAnonymise
+	a.background(func() {
+		data := map[string]any{
+			"username":  user.Username,
+			"anonymise": anonymise,
+		}
+		err := a.mailer.Send(user.Email, "account_deleted.tmpl", data)
+		if err != nil {
+			a.logger.Error(err.Error())
+		}
+	})
+
+	data := envelope{
+		"message": "your account was successfully deleted",
+	}
+
+	err = a.writeJSON(w, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErr(w, r, err)
+	}
+}
+
+/* Unlock an account that was locked by failed logins (admin only) */
+func (a *appDependencies) unlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := a.readIDParam(r)
+	if err != nil {
+		a.notFound(w, r)
+		return
+	}
+
+	user, err := a.userModel.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.notFound(w, r)
+		default:
+			a.serverErr(w, r, err)
+		}
+		return
+	}
+
+	err = a.loginAttemptModel.Reset(user.ID)
+	if err != nil {
+		a.serverErr(w, r, err)
+		return
+	}
+
+	data := envelope{
+		"message": "account successfully unlocked",
+	}
+
+	err = a.writeJSON(w, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErr(w, r, err)
+	}
+}
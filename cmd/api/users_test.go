@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/thats-insane/awt-test3/internal/data"
+)
+
+func TestChangePasswordRevokesOtherSessions(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApp(db)
+
+	ts := httptest.NewServer(app.routes())
+	defer ts.Close()
+
+	user, current := newTestUser(t, app, "alice", "books:read")
+	other, err := app.tokenModel.New(user.ID, time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refresh, err := app.tokenModel.New(user.ID, time.Hour, data.ScopeRefresh)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changePassword := func(currentPassword string) (int, map[string]any) {
+		t.Helper()
+		return doJSON(t, ts, http.MethodPatch, "/api/v1/users/me", current, "application/json",
+			`{"password": "n3w-B4ttery-h0rse-staple", "current_password": "`+currentPassword+`"}`)
+	}
+
+	// a wrong current password counts towards the lockout
+	status, body := changePassword("not-my-password")
+	if status != http.StatusUnprocessableEntity {
+		t.Fatalf("wrong current password: got status %d, body %v", status, body)
+	}
+	attempt, err := app.loginAttemptModel.Get(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempt.FailedCount != 1 {
+		t.Errorf("got %d failed attempts, want 1", attempt.FailedCount)
+	}
+
+	status, body = changePassword("c0rrect-H0rse-b4ttery")
+	if status != http.StatusOK {
+		t.Fatalf("change password: got status %d, body %v", status, body)
+	}
+
+	attempt, err = app.loginAttemptModel.Get(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempt.FailedCount != 0 {
+		t.Errorf("got %d failed attempts after a successful change, want 0", attempt.FailedCount)
+	}
+
+	status, _ = doJSON(t, ts, http.MethodGet, "/api/v1/users/me", current, "", "")
+	if status != http.StatusOK {
+		t.Errorf("current session: got status %d, want %d", status, http.StatusOK)
+	}
+	status, _ = doJSON(t, ts, http.MethodGet, "/api/v1/users/me", other.Plaintext, "", "")
+	if status != http.StatusUnauthorized {
+		t.Errorf("other session: got status %d, want %d", status, http.StatusUnauthorized)
+	}
+	_, err = app.tokenModel.GetRefresh(refresh.Plaintext)
+	if !errors.Is(err, data.ErrRecordNotFound) {
+		t.Errorf("refresh token after the password changed: got %v, want %v", err, data.ErrRecordNotFound)
+	}
+}
+
+func TestChangePasswordLockout(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApp(db)
+
+	ts := httptest.NewServer(app.routes())
+	defer ts.Close()
+
+	_, session := newTestUser(t, app, "alice", "books:read")
+
+	for i := 0; i < data.MaxFailedLogins; i++ {
+		status, body := doJSON(t, ts, http.MethodPatch, "/api/v1/users/me", session, "application/json",
+			`{"password": "n3w-B4ttery-h0rse-staple", "current_password": "guess-number-one"}`)
+		if status != http.StatusUnprocessableEntity {
+			t.Fatalf("guess %d: got status %d, body %v", i+1, status, body)
+		}
+	}
+
+	// locked now, even the right password is refused
+	status, body := doJSON(t, ts, http.MethodPatch, "/api/v1/users/me", session, "application/json",
+		`{"password": "n3w-B4ttery-h0rse-staple", "current_password": "c0rrect-H0rse-b4ttery"}`)
+	if status != http.StatusTooManyRequests {
+		t.Errorf("after %d guesses: got status %d, body %v", data.MaxFailedLogins, status, body)
+	}
+}
+
+func TestCreateUserGrantsBooksRead(t *testing.T) {
+	db := newTestDB(t)
+	app := newTestApp(db)
+
+	ts := httptest.NewServer(app.routes())
+	defer ts.Close()
+
+	status, body := doJSON(t, ts, http.MethodPost, "/api/v1/users", "", "application/json",
+		`{"username": "newcomer", "email": "newcomer@example.com", "password": "c0rrect-H0rse-b4ttery"}`)
+	if status != http.StatusCreated {
+		t.Fatalf("create user: got status %d, body %v", status, body)
+	}
+	id := int64(body["user"].(map[string]any)["id"].(float64))
+
+	permissions, err := app.permissionModel.GetAllForUser(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !permissions.Include("books:read") || permissions.Include("books:write") {
+		t.Errorf("got permissions %v, want only books:read", permissions)
+	}
+}
@@ -4,13 +4,13 @@ go 1.22.1
 
 require (
 	github.com/go-mail/mail/v2 v2.3.0
-	github.com/julienschmidt/httprouter v1.3.0
 	github.com/lib/pq v1.10.9
 	golang.org/x/crypto v0.29.0
 	golang.org/x/time v0.8.0
 )
 
 require (
+	golang.org/x/sys v0.27.0 // indirect
 	gopkg.in/alexcesaro/quotedprintable.v3 v3.0.0-20150716171945-2caba252f4dc // indirect
 	gopkg.in/mail.v2 v2.3.1 // indirect
 )
@@ -0,0 +1,196 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/thats-insane/awt-test3/internal/validator"
+)
+
+/* Every key starts with this so they are easy to spot in scripts and secret scanners */
+const apiKeyPrefix = "bk_"
+
+type APIKey struct {
+	ID         int64      `json:"id"`
+	UserID     int64      `json:"-"`
+	Name       string     `json:"name"`
+	Plaintext  string     `json:"key,omitempty"`
+	Hash       []byte     `json:"-"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Expiry     *time.Time `json:"expiry"`
+}
+
+type APIKeyModel struct {
+	DB *sql.DB
+}
+
+/* Generate a new key and insert it into the database, the plaintext is only available on the returned key */
+func (k APIKeyModel) New(key *APIKey) error {
+	randomBytes := make([]byte, 20)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return err
+	}
+
+	key.Plaintext = apiKeyPrefix + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+	key.Hash = HashTokenPlaintext(key.Plaintext)
+	key.Prefix = key.Plaintext[:len(apiKeyPrefix)+6]
+
+	query := `
+		INSERT INTO api_keys (user_id, name, hash, prefix, scopes, expiry)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at
+	`
+
+	args := []any{key.UserID, key.Name, key.Hash, key.Prefix, pq.Array(key.Scopes), key.Expiry}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return k.DB.QueryRowContext(ctx, query, args...).Scan(&key.ID, &key.CreatedAt)
+}
+
+/* Select all keys belonging to a user */
+func (k APIKeyModel) GetAllForUser(userID int64) ([]*APIKey, error) {
+	query := `
+		SELECT id, user_id, name, prefix, scopes, created_at, last_used_at, expiry
+		FROM api_keys
+		WHERE user_id = $1
+		ORDER BY id
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := k.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+
+	for rows.Next() {
+		var key APIKey
+		err := rows.Scan(&key.ID, &key.UserID, &key.Name, &key.Prefix, pq.Array(&key.Scopes), &key.CreatedAt, &key.LastUsedAt, &key.Expiry)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, &key)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+/* Select the user and key for an unexpired API key */
+func (k APIKeyModel) GetForKey(plaintext string) (*User, *APIKey, error) {
+	query := `
+		SELECT users.id, users.created_at, users.username, users.email, users.password, users.activated, users.admin, users.version,
+			api_keys.id, api_keys.name, api_keys.prefix, api_keys.scopes, api_keys.created_at, api_keys.last_used_at, api_keys.expiry
+		FROM users
+		INNER JOIN api_keys
+		ON users.id = api_keys.user_id
+		WHERE api_keys.hash = $1
+		AND (api_keys.expiry IS NULL OR api_keys.expiry > $2)
+	`
+
+	var user User
+	var key APIKey
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := k.DB.QueryRowContext(ctx, query, HashTokenPlaintext(plaintext), time.Now()).Scan(
+		&user.ID, &user.CreatedAt, &user.Username, &user.Email, &user.Password.hash, &user.Activated, &user.Admin, &user.Version,
+		&key.ID, &key.Name, &key.Prefix, pq.Array(&key.Scopes), &key.CreatedAt, &key.LastUsedAt, &key.Expiry,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	key.UserID = user.ID
+	return &user, &key, nil
+}
+
+/* Record that a key was just used (at most once a minute to limit writes) */
+func (k APIKeyModel) UpdateLastUsed(id int64) error {
+	query := `
+		UPDATE api_keys
+		SET last_used_at = NOW()
+		WHERE id = $1
+		AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := k.DB.ExecContext(ctx, query, id)
+	return err
+}
+
+/* Revoke one of a user's keys */
+func (k APIKeyModel) Delete(id int64, userID int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM api_keys
+		WHERE id = $1 AND user_id = $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := k.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+/* Check that a header value looks like one of our API keys */
+func ValidateAPIKeyPlaintext(v *validator.Validator, plaintext string) {
+	v.Check(strings.HasPrefix(plaintext, apiKeyPrefix), "key", "must be an API key")
+	v.Check(len(plaintext) == len(apiKeyPrefix)+32, "key", "must be 35 bytes")
+}
+
+/* Validation for API key, scopes must be permissions the user already has */
+func ValidateAPIKey(v *validator.Validator, key *APIKey, permissions Permissions) {
+	v.Check(key.Name != "", "name", "must be provided")
+	v.Check(len(key.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(len(key.Scopes) > 0, "scopes", "must contain at least one scope")
+	for _, scope := range key.Scopes {
+		v.Check(permissions.Include(scope), "scopes", "must only contain permissions you have been granted")
+	}
+	if key.Expiry != nil {
+		v.Check(key.Expiry.After(time.Now()), "expiry", "must be in the future")
+	}
+}
@@ -5,20 +5,53 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
+	"github.com/lib/pq"
 	"github.com/thats-insane/awt-test3/internal/validator"
 )
 
 type Book struct {
-	ID        int64     `json:"id"`
-	Title     string    `json:"title"`
-	Author    string    `json:"author"`
-	ISBN      string    `json:"isbn"`
-	PubDate   time.Time `json:"pub_date"`
-	Genre     string    `json:"genre"`
-	Desc      string    `json:"description"`
-	AvgRating float64   `json:"avg_rating"`
+	ID          int64     `json:"id"`
+	Title       string    `json:"title"`
+	Author      string    `json:"author"`
+	ISBN        string    `json:"isbn"`
+	PubDate     time.Time `json:"pub_date"`
+	Genre       string    `json:"genre"`
+	Desc        string    `json:"description"`
+	AvgRating   float64   `json:"avg_rating"`
+	ReviewCount int       `json:"review_count"`
+	Language    string    `json:"language"`
+}
+
+/* Book with its search relevance and a highlighted snippet of the match */
+type BookSearchResult struct {
+	*Book
+	Rank    float64 `json:"rank"`
+	Snippet string  `json:"snippet,omitempty"`
+}
+
+const SearchModeFullText = "fulltext"
+const SearchModeFuzzy = "fuzzy"
+
+/* A title or author completing a search box prefix */
+type Completion struct {
+	Text  string `json:"text"`
+	Field string `json:"field"`
+}
+
+/* Text search configurations a book or search may use for stemming */
+var SearchLanguages = []string{"simple", "english", "french", "german", "spanish", "italian", "portuguese", "dutch"}
+
+/* Public sort keys for books and the columns they order by; books without a date sort first */
+var BookSortColumns = map[string]string{
+	"id":           "id",
+	"title":        "title",
+	"author":       "author",
+	"pub_date":     "coalesce(publication_date, '-infinity'::date)",
+	"avg_rating":   "average_rating",
+	"review_count": "review_count",
 }
 
 type BookModel struct {
@@ -28,17 +61,17 @@ type BookModel struct {
 /* Add a new book */
 func (b BookModel) Insert(book *Book) error {
 	query := `
-		INSERT INTO books (title, author, isbn, publication_date, genre, description, average_rating) 
+		INSERT INTO books (title, author, isbn, publication_date, genre, description, language) 
 		VALUES ($1, $2, $3, $4, $5, $6, $7)
-		RETURNING id
+		RETURNING id, average_rating, review_count
 	`
 
-	args := []any{book.Title, book.Author, book.ISBN, book.PubDate, book.Genre, book.Desc, book.AvgRating}
+	args := []any{book.Title, book.Author, book.ISBN, book.PubDate, book.Genre, book.Desc, book.Language}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	return b.DB.QueryRowContext(ctx, query, args...).Scan(&book.ID)
+	return b.DB.QueryRowContext(ctx, query, args...).Scan(&book.ID, &book.AvgRating, &book.ReviewCount)
 }
 
 /* Select a book */
@@ -48,7 +81,7 @@ func (b BookModel) Get(id int64) (*Book, error) {
 	}
 
 	query := `
-		SELECT id, title, author, isbn, publication_date, genre, description, average_rating
+		SELECT id, title, author, isbn, publication_date, genre, description, average_rating, review_count, language
 		FROM books
 		WHERE id = $1
 	`
@@ -57,7 +90,7 @@ func (b BookModel) Get(id int64) (*Book, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := b.DB.QueryRowContext(ctx, query, id).Scan(&book.ID, &book.Title, &book.Author, &book.ISBN, &book.Author, &book.PubDate, &book.Genre, &book.Desc, &book.AvgRating)
+	err := b.DB.QueryRowContext(ctx, query, id).Scan(&book.ID, &book.Title, &book.Author, &book.ISBN, &book.PubDate, &book.Genre, &book.Desc, &book.AvgRating, &book.ReviewCount, &book.Language)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -69,30 +102,104 @@ func (b BookModel) Get(id int64) (*Book, error) {
 	return &book, nil
 }
 
-/* Select all books */
-func (b BookModel) GetAll(filters Filters) ([]*Book, Metadata, error) {
+/* Fetch many books in one query, keyed by book ID */
+func (b BookModel) GetMany(ids []int64) (map[int64]*Book, error) {
+	query := `
+		SELECT id, title, author, isbn, publication_date, genre, description, average_rating, review_count, language
+		FROM books
+		WHERE id = ANY($1)
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := b.DB.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	books := make(map[int64]*Book)
+	for rows.Next() {
+		var book Book
+		err := rows.Scan(&book.ID, &book.Title, &book.Author, &book.ISBN, &book.PubDate, &book.Genre, &book.Desc, &book.AvgRating, &book.ReviewCount, &book.Language)
+		if err != nil {
+			return nil, err
+		}
+		books[book.ID] = &book
+	}
+
+	return books, rows.Err()
+}
+
+/* Optional narrowing of the book list, zero values mean no filter */
+type BookFilters struct {
+	Genres     []string
+	Author     string
+	YearFrom   int
+	YearTo     int
+	MinRating  float64
+	HasReviews *bool
+}
+
+/* Count of books sharing a facet value */
+type Facet struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+type BookFacets struct {
+	Genres  []Facet `json:"genre"`
+	Decades []Facet `json:"decade"`
+}
+
+/* WHERE clause shared by the list and facet queries, filled by BookFilters.args */
+const bookFilterClause = `
+		WHERE (cardinality($1::text[]) = 0 OR lower(genre) = ANY($1))
+		AND ($2 = '' OR author ILIKE '%' || $2 || '%')
+		AND ($3 = 0 OR EXTRACT(YEAR FROM publication_date) >= $3)
+		AND ($4 = 0 OR EXTRACT(YEAR FROM publication_date) <= $4)
+		AND average_rating >= $5
+		AND ($6::boolean IS NULL OR (review_count > 0) = $6)
+`
+
+func (f BookFilters) args() []any {
+	genres := make([]string, len(f.Genres))
+	for i, genre := range f.Genres {
+		genres[i] = strings.ToLower(genre)
+	}
+	return []any{pq.Array(genres), escapeLike(f.Author), f.YearFrom, f.YearTo, f.MinRating, f.HasReviews}
+}
+
+/* Select all books matching the filters, by page number or after a cursor */
+func (b BookModel) GetAll(bookFilters BookFilters, filters Filters) ([]*Book, Metadata, error) {
+	keyset, limit, pageArgs := filters.page(7)
 	query := fmt.Sprintf(`
-		SELECT id, title, author, isbn, publication_date, genre, description, average_rating
+		SELECT count(*) OVER(), %s, id, title, author, isbn, publication_date, genre, description, average_rating, review_count, language
 		FROM books
-		ORDER BY %s %s, id ASC
-		LIMIT $1 OFFSET $2
-		`, filters.sortColumn(), filters.sortDirection())
+		%s
+		AND %s
+		ORDER BY %s
+		%s
+		`, filters.sortKeySelect(), bookFilterClause, keyset, filters.orderBy(), limit)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	rows, err := b.DB.QueryContext(ctx, query, filters.limit(), filters.offset())
+	args := append(bookFilters.args(), pageArgs...)
+	rows, err := b.DB.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, Metadata{}, err
 	}
 	defer rows.Close()
 
 	var totalRecords int
+	var lastKeys []string
 	books := []*Book{}
 
 	for rows.Next() {
 		var book Book
-		err := rows.Scan(&book.ID, &book.Title, &book.Author, &book.ISBN, &book.PubDate, &book.Genre, &book.Desc, &book.AvgRating)
+		err := rows.Scan(&totalRecords, pq.Array(&lastKeys), &book.ID, &book.Title, &book.Author, &book.ISBN, &book.PubDate, &book.Genre, &book.Desc, &book.AvgRating, &book.ReviewCount, &book.Language)
 		if err != nil {
 			return nil, Metadata{}, err
 		}
@@ -104,25 +211,96 @@ func (b BookModel) GetAll(filters Filters) ([]*Book, Metadata, error) {
 		return nil, Metadata{}, err
 	}
 
-	metadata := calculateMetaData(totalRecords, filters.Page, filters.PageSize)
+	var lastID int64
+	if len(books) > 0 {
+		lastID = books[len(books)-1].ID
+	}
+	metadata := filters.metadata(totalRecords, len(books), lastKeys, lastID)
 
 	return books, metadata, nil
 }
 
-/* Update a book */
-func (b BookModel) Update(book *Book, id int64) error {
+/*
+Count the filtered books per genre and per decade. Each facet ignores its own filter
+so clients can see how many books picking another genre or decade would give
+*/
+func (b BookModel) Facets(bookFilters BookFilters) (*BookFacets, error) {
+	genreFilters := bookFilters
+	genreFilters.Genres = nil
+	genres, err := b.facet(`
+		SELECT coalesce(genre, ''), count(*)
+		FROM books
+		`+bookFilterClause+`
+		GROUP BY 1
+		ORDER BY 2 DESC, 1 ASC
+	`, genreFilters)
+	if err != nil {
+		return nil, err
+	}
+
+	decadeFilters := bookFilters
+	decadeFilters.YearFrom, decadeFilters.YearTo = 0, 0
+	decades, err := b.facet(`
+		SELECT (EXTRACT(YEAR FROM publication_date)::int / 10 * 10)::text || 's', count(*)
+		FROM books
+		`+bookFilterClause+`
+		AND publication_date IS NOT NULL
+		GROUP BY 1
+		ORDER BY 1 ASC
+	`, decadeFilters)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BookFacets{Genres: genres, Decades: decades}, nil
+}
+
+func (b BookModel) facet(query string, bookFilters BookFilters) ([]Facet, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := b.DB.QueryContext(ctx, query, bookFilters.args()...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	facets := []Facet{}
+	for rows.Next() {
+		var facet Facet
+		err := rows.Scan(&facet.Value, &facet.Count)
+		if err != nil {
+			return nil, err
+		}
+		facets = append(facets, facet)
+	}
+
+	return facets, rows.Err()
+}
+
+/* Update a book; the rating columns are maintained from reviews */
+func (b BookModel) Update(book *Book) error {
 	query := `
 		UPDATE books
-		SET title = $1, author = $2, isbn = $3, publication_date = $3, genre = $4, description = $5, average_rating = $6
-		WHERE id = $7
-		RETURNING id
+		SET title = $1, author = $2, isbn = $3, publication_date = $4, genre = $5, description = $6, language = $7
+		WHERE id = $8
+		RETURNING average_rating, review_count
 	`
 
-	args := []any{book.Title, book.Author, book.ISBN, book.PubDate, book.Genre, book.Desc, book.AvgRating, book.ID}
+	args := []any{book.Title, book.Author, book.ISBN, book.PubDate, book.Genre, book.Desc, book.Language, book.ID}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	return b.DB.QueryRowContext(ctx, query, args...).Scan(&book.ID)
+	err := b.DB.QueryRowContext(ctx, query, args...).Scan(&book.AvgRating, &book.ReviewCount)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+	return nil
 }
 
 /* Delete a book */
@@ -155,40 +333,52 @@ func (b BookModel) Delete(id int64) error {
 	return nil
 }
 
-/* Select a book using filters */
-func (b BookModel) Search(title string, author string, genre string, filters Filters) ([]*Book, Metadata, error) {
+/* Full-text search over title, author, genre and description, or trigram matching on title and author in fuzzy mode */
+func (b BookModel) Search(q string, language string, mode string, filters Filters) ([]*BookSearchResult, Metadata, error) {
 	query := `
-        SELECT id, title, author, isbn, publication_date, genre, description, average_rating
-		FROM books
-        WHERE (to_tsvector('simple', title) @@
-              plainto_tsquery('simple', $1) OR $1 = '')
-        AND (to_tsvector('simple', author) @@
-             plainto_tsquery('simple', $2) OR $2 = '')
-		AND (to_tsvector('simple', genre) @@
-             plainto_tsquery('simple', $3) OR $3 = '')
-        ORDER BY id
-		LIMIT $4 OFFSET $5
-     `
+		SELECT count(*) OVER(), id, title, author, isbn, publication_date, genre, description, average_rating, review_count, language,
+			ts_rank(search_vector, query) AS rank,
+			ts_headline(language, coalesce(description, ''), query, 'MaxFragments=2, MinWords=5, MaxWords=20')
+		FROM books, websearch_to_tsquery($2::regconfig, $1) query
+		WHERE search_vector @@ query
+		ORDER BY rank DESC, id ASC
+		LIMIT $3 OFFSET $4
+	`
+	args := []any{q, language, filters.limit(), filters.offset()}
+
+	// word_similarity lets "tolkein" match a word inside "J.R.R. Tolkien"
+	if mode == SearchModeFuzzy {
+		query = `
+			SELECT count(*) OVER(), id, title, author, isbn, publication_date, genre, description, average_rating, review_count, language,
+				greatest(word_similarity($1, title), word_similarity($1, author)) AS rank,
+				''
+			FROM books
+			WHERE $1 <% title OR $1 <% author
+			ORDER BY rank DESC, id ASC
+			LIMIT $2 OFFSET $3
+		`
+		args = []any{q, filters.limit(), filters.offset()}
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	rows, err := b.DB.QueryContext(ctx, query, title, author, genre)
+	rows, err := b.DB.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, Metadata{}, err
 	}
 	defer rows.Close()
 
 	var totalRecords int
-	books := []*Book{}
+	results := []*BookSearchResult{}
 
 	for rows.Next() {
-		var book Book
-		err := rows.Scan(&book.ID, &book.Title, &book.Author, &book.ISBN, &book.PubDate, &book.Genre, &book.Desc, &book.AvgRating)
+		result := BookSearchResult{Book: &Book{}}
+		err := rows.Scan(&totalRecords, &result.ID, &result.Title, &result.Author, &result.ISBN, &result.PubDate, &result.Genre, &result.Desc, &result.AvgRating, &result.ReviewCount, &result.Language, &result.Rank, &result.Snippet)
 		if err != nil {
 			return nil, Metadata{}, err
 		}
-		books = append(books, &book)
+		results = append(results, &result)
 	}
 
 	err = rows.Err()
@@ -198,7 +388,109 @@ func (b BookModel) Search(title string, author string, genre string, filters Fil
 
 	metadata := calculateMetaData(totalRecords, filters.Page, filters.PageSize)
 
-	return books, metadata, nil
+	return results, metadata, nil
+}
+
+/* Titles and authors that look like a query, used as "did you mean" suggestions */
+func (b BookModel) Suggest(q string, limit int) ([]string, error) {
+	query := `
+		SELECT term
+		FROM (
+			SELECT title AS term, word_similarity($1, title) AS score FROM books WHERE $1 <% title
+			UNION ALL
+			SELECT author, word_similarity($1, author) FROM books WHERE $1 <% author
+		) matches
+		GROUP BY term
+		ORDER BY max(score) DESC, term ASC
+		LIMIT $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := b.DB.QueryContext(ctx, query, q, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	suggestions := []string{}
+	for rows.Next() {
+		var term string
+		err := rows.Scan(&term)
+		if err != nil {
+			return nil, err
+		}
+		suggestions = append(suggestions, term)
+	}
+
+	return suggestions, rows.Err()
+}
+
+/* Titles and authors starting with a prefix, at the start of the text or of any word in it */
+func (b BookModel) Autocomplete(prefix string, limit int) ([]*Completion, error) {
+	query := `
+		SELECT text, field
+		FROM (
+			SELECT DISTINCT title AS text, 'title' AS field FROM books WHERE title ILIKE $1 || '%' OR title ILIKE '% ' || $1 || '%'
+			UNION
+			SELECT DISTINCT author, 'author' FROM books WHERE author ILIKE $1 || '%' OR author ILIKE '% ' || $1 || '%'
+		) completions
+		ORDER BY text ILIKE $1 || '%' DESC, length(text) ASC, text ASC
+		LIMIT $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := b.DB.QueryContext(ctx, query, escapeLike(prefix), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	completions := []*Completion{}
+	for rows.Next() {
+		var completion Completion
+		err := rows.Scan(&completion.Text, &completion.Field)
+		if err != nil {
+			return nil, err
+		}
+		completions = append(completions, &completion)
+	}
+
+	return completions, rows.Err()
+}
+
+/* Escape LIKE wildcards so user input only matches literally */
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+/* Validation for the book list filters */
+func ValidateBookFilters(v *validator.Validator, f BookFilters) {
+	v.Check(len(f.Genres) <= 20, "genre", "must not have more than 20 values")
+	v.Check(len(f.Author) <= 255, "author", "must not be more than 255 bytes long")
+	v.Check(f.YearFrom >= 0 && f.YearFrom <= 9999, "year_from", "must be a valid year")
+	v.Check(f.YearTo >= 0 && f.YearTo <= 9999, "year_to", "must be a valid year")
+	v.Check(f.YearFrom == 0 || f.YearTo == 0 || f.YearFrom <= f.YearTo, "year_to", "must not be before year_from")
+	v.Check(f.MinRating >= 0 && f.MinRating <= 5, "min_rating", "must be between 0 and 5")
+}
+
+/* Validation for a search query */
+func ValidateSearch(v *validator.Validator, q string, language string, mode string) {
+	v.Check(q != "", "q", "must be provided")
+	v.Check(len(q) <= 200, "q", "must not be more than 200 bytes long")
+	v.Check(validator.PermittedValue(language, SearchLanguages...), "lang", "must be a supported language")
+	v.Check(validator.PermittedValue(mode, SearchModeFullText, SearchModeFuzzy), "mode", "must be fulltext or fuzzy")
+}
+
+/* Validation for an autocomplete request */
+func ValidateAutocomplete(v *validator.Validator, prefix string, limit int) {
+	v.Check(prefix != "", "prefix", "must be provided")
+	v.Check(len(prefix) <= 100, "prefix", "must not be more than 100 bytes long")
+	v.Check(limit > 0, "limit", "must be greater than zero")
+	v.Check(limit <= 20, "limit", "must be a maximum of 20")
 }
 
 /* Validation for book */
@@ -208,5 +500,5 @@ func ValidateBook(v *validator.Validator, book *Book) {
 	v.Check(book.ISBN != "", "book", "must be provided")
 	v.Check(book.Genre != "", "book", "must be provided")
 	v.Check(book.Desc != "", "book", "must be provided")
-	v.Check(book.AvgRating >= 1 && book.AvgRating <= 5, "book", "must be between 1 and 5")
+	v.Check(validator.PermittedValue(book.Language, SearchLanguages...), "language", "must be a supported language")
 }
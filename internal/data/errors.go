@@ -5,3 +5,5 @@ import "errors"
 var ErrRecordNotFound = errors.New("record not found")
 var ErrDuplicateEmail = errors.New("duplicate email")
 var ErrEditConflict = errors.New("edit conflict")
+var ErrTokenReused = errors.New("token reused")
+var ErrCodeReused = errors.New("code reused")
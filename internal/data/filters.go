@@ -1,24 +1,56 @@
 package data
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/thats-insane/awt-test3/internal/validator"
 )
 
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+/* Key signing pagination cursors, set once at startup */
+var CursorKey []byte
+
+/* Most keys a sort may combine */
+const maxSortKeys = 5
+
 type Filters struct {
-	Page         int
-	PageSize     int
-	Sort         string
-	SortSafeList []string
+	Page        int
+	PageSize    int
+	Sort        string
+	SortColumns map[string]string
+	Cursor      string
+}
+
+/* One column of a sort such as "-avg_rating,title" */
+type sortKey struct {
+	column string
+	desc   bool
+}
+
+/* Position after the last row of a page: its sort keys and id, for the sort it was made with */
+type cursor struct {
+	Sort string   `json:"s"`
+	Keys []string `json:"k"`
+	ID   int64    `json:"i"`
 }
 
 type Metadata struct {
-	CurrentPage  int `json:"current_page,omitempty"`
-	PageSize     int `json:"page_size,omitempty"`
-	FirstPage    int `json:"first_page,omitempty"`
-	LastPage     int `json:"last_page,omitempty"`
-	TotalRecords int `json:"total_records,omitempty"`
+	CurrentPage  int    `json:"current_page,omitempty"`
+	PageSize     int    `json:"page_size,omitempty"`
+	FirstPage    int    `json:"first_page,omitempty"`
+	PrevPage     int    `json:"prev_page,omitempty"`
+	NextPage     int    `json:"next_page,omitempty"`
+	LastPage     int    `json:"last_page,omitempty"`
+	TotalRecords int    `json:"total_records,omitempty"`
+	NextCursor   string `json:"next_cursor,omitempty"`
 }
 
 func calculateMetaData(totalRecords int, currentPage int, pageSize int) Metadata {
@@ -26,14 +58,80 @@ func calculateMetaData(totalRecords int, currentPage int, pageSize int) Metadata
 		return Metadata{}
 	}
 
-	return Metadata{
+	metadata := Metadata{
 		CurrentPage:  currentPage,
 		PageSize:     pageSize,
 		FirstPage:    1,
 		LastPage:     (totalRecords + pageSize - 1) / pageSize,
 		TotalRecords: totalRecords,
 	}
+	if currentPage > 1 {
+		metadata.PrevPage = currentPage - 1
+	}
+	if currentPage < metadata.LastPage {
+		metadata.NextPage = currentPage + 1
+	}
+
+	return metadata
+}
+
+/*
+Metadata for a page of returned rows. totalRecords comes from count(*) OVER(), which in
+cursor mode only counts the rows after the cursor, so page numbers are left out there
+*/
+func (f Filters) metadata(totalRecords int, returned int, lastKeys []string, lastID int64) Metadata {
+	var metadata Metadata
+	var more bool
+	if f.Cursor != "" {
+		metadata = Metadata{PageSize: f.PageSize}
+		more = returned < totalRecords
+	} else {
+		metadata = calculateMetaData(totalRecords, f.Page, f.PageSize)
+		more = f.offset()+returned < totalRecords
+	}
+
+	if more {
+		metadata.NextCursor = encodeCursor(cursor{Sort: f.Sort, Keys: lastKeys, ID: lastID})
+	}
+	return metadata
+}
+
+func encodeCursor(c cursor) string {
+	payload, _ := json.Marshal(c)
+	mac := hmac.New(sha256.New, CursorKey)
+	mac.Write(payload)
+
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+/* Decode a cursor, rejecting any that were not signed with CursorKey */
+func decodeCursor(s string) (*cursor, error) {
+	encodedPayload, encodedSignature, found := strings.Cut(s, ".")
+	if !found {
+		return nil, ErrInvalidCursor
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	mac := hmac.New(sha256.New, CursorKey)
+	mac.Write(payload)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, ErrInvalidCursor
+	}
 
+	var c cursor
+	err = json.Unmarshal(payload, &c)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &c, nil
 }
 
 func ValidateFilters(v *validator.Validator, f Filters) {
@@ -42,9 +140,21 @@ func ValidateFilters(v *validator.Validator, f Filters) {
 	v.Check(f.PageSize > 0, "page_size", "must be greater than zero")
 	v.Check(f.PageSize <= 100, "page_size", "must be a maximum of 100")
 
-	v.Check(validator.PermittedValue(f.Sort, f.SortSafeList...), "sort",
-		"invalid sort value")
+	names := strings.Split(f.Sort, ",")
+	v.Check(len(names) <= maxSortKeys, "sort", fmt.Sprintf("must not have more than %d keys", maxSortKeys))
+	seen := make(map[string]bool)
+	for _, name := range names {
+		name = strings.TrimPrefix(strings.TrimSpace(name), "-")
+		_, ok := f.SortColumns[name]
+		v.Check(ok, "sort", "invalid sort value "+strconv.Quote(name))
+		v.Check(!seen[name], "sort", "must not repeat "+strconv.Quote(name))
+		seen[name] = true
+	}
 
+	if f.Cursor != "" {
+		c, err := decodeCursor(f.Cursor)
+		v.Check(err == nil && c.Sort == f.Sort && len(c.Keys) == len(f.sortKeys()), "cursor", "must be a next_cursor from an earlier page with the same sort")
+	}
 }
 
 func (f Filters) limit() int {
@@ -55,18 +165,91 @@ func (f Filters) offset() int {
 	return (f.Page - 1) * f.PageSize
 }
 
-func (f Filters) sortColumn() string {
-	for _, safeValue := range f.SortSafeList {
-		if f.Sort == safeValue {
-			return strings.TrimPrefix(f.Sort, "-")
+/* Map the public sort keys to their columns, keys the model doesn't declare are skipped */
+func (f Filters) sortKeys() []sortKey {
+	var keys []sortKey
+	for _, name := range strings.Split(f.Sort, ",") {
+		name = strings.TrimSpace(name)
+		column, ok := f.SortColumns[strings.TrimPrefix(name, "-")]
+		if !ok || len(keys) == maxSortKeys {
+			continue
 		}
+		keys = append(keys, sortKey{column: column, desc: strings.HasPrefix(name, "-")})
 	}
-	panic("unsafe sort parameter: " + f.Sort)
+	return keys
 }
 
-func (f Filters) sortDirection() string {
-	if strings.HasPrefix(f.Sort, "-") {
-		return "DESC"
+/* Sort keys plus id as the final tie-breaker, so every row has a unique position */
+func (f Filters) orderKeys() []sortKey {
+	keys := f.sortKeys()
+	for _, key := range keys {
+		if key.column == "id" {
+			return keys
+		}
 	}
-	return "ASC"
+	return append(keys, sortKey{column: "id"})
+}
+
+func (f Filters) orderBy() string {
+	var columns []string
+	for _, key := range f.orderKeys() {
+		direction := "ASC"
+		if key.desc {
+			direction = "DESC"
+		}
+		columns = append(columns, key.column+" "+direction)
+	}
+	return strings.Join(columns, ", ")
+}
+
+/* Select expression giving a row's sort key values as text, to put in the next cursor */
+func (f Filters) sortKeySelect() string {
+	var columns []string
+	for _, key := range f.sortKeys() {
+		columns = append(columns, key.column+"::text")
+	}
+	return "ARRAY[" + strings.Join(columns, ", ") + "]::text[]"
+}
+
+/*
+Keyset condition (just "true" without a cursor) and the LIMIT/OFFSET clause, with
+placeholders numbered from $next. Directions can be mixed, so the condition is spelled
+out as (a > $1) OR (a = $1 AND b < $2) OR ... rather than a row comparison
+*/
+func (f Filters) page(next int) (string, string, []any) {
+	if f.Cursor == "" {
+		return "true", fmt.Sprintf("LIMIT $%d OFFSET $%d", next, next+1), []any{f.limit(), f.offset()}
+	}
+
+	keys := f.orderKeys()
+	c, err := decodeCursor(f.Cursor)
+	if err != nil || len(c.Keys) != len(f.sortKeys()) {
+		// ValidateFilters rejects these, never match anything if it was skipped
+		return "false", fmt.Sprintf("LIMIT $%d", next), []any{f.limit()}
+	}
+
+	var args []any
+	for _, key := range c.Keys {
+		args = append(args, key)
+	}
+	if len(keys) > len(c.Keys) {
+		args = append(args, c.ID)
+	}
+
+	var clauses []string
+	for i, key := range keys {
+		var parts []string
+		for j := 0; j < i; j++ {
+			parts = append(parts, fmt.Sprintf("%s = $%d", keys[j].column, next+j))
+		}
+		comparison := ">"
+		if key.desc {
+			comparison = "<"
+		}
+		parts = append(parts, fmt.Sprintf("%s %s $%d", key.column, comparison, next+i))
+		clauses = append(clauses, "("+strings.Join(parts, " AND ")+")")
+	}
+
+	keyset := "(" + strings.Join(clauses, " OR ") + ")"
+	return keyset, fmt.Sprintf("LIMIT $%d", next+len(args)), append(args, f.limit())
 }
@@ -0,0 +1,186 @@
+package data
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrUnknownHashFormat = errors.New("unknown password hash format")
+
+/* A password hashing scheme that can recognise its own encoded hashes */
+type PasswordHasher interface {
+	Hash(plaintext string) ([]byte, error)
+	Matches(hash []byte, plaintext string) (bool, error)
+	Owns(hash []byte) bool
+	NeedsRehash(hash []byte) bool
+}
+
+/* Hasher used for new passwords; older formats are still verified */
+var DefaultHasher PasswordHasher = Argon2idHasher{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+/* Hashers tried in order when verifying a stored hash */
+var LegacyHashers = []PasswordHasher{
+	BcryptHasher{Cost: 12},
+}
+
+/* Find the hasher that produced a stored hash */
+func hasherFor(hash []byte) (PasswordHasher, error) {
+	if DefaultHasher.Owns(hash) {
+		return DefaultHasher, nil
+	}
+	for _, h := range LegacyHashers {
+		if h.Owns(hash) {
+			return h, nil
+		}
+	}
+	return nil, ErrUnknownHashFormat
+}
+
+/* Argon2id with the PHC encoded format $argon2id$v=19$m=..,t=..,p=..$salt$hash */
+type Argon2idHasher struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+type argon2idHash struct {
+	params Argon2idHasher
+	salt   []byte
+	key    []byte
+}
+
+/* Hash a password with a random salt */
+func (h Argon2idHasher) Hash(plaintext string) ([]byte, error) {
+	salt := make([]byte, h.SaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	key := argon2.IDKey([]byte(plaintext), salt, h.Iterations, h.Memory, h.Parallelism, h.KeyLength)
+	encoded := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.Memory, h.Iterations, h.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key))
+
+	return []byte(encoded), nil
+}
+
+/* Compare a password against an encoded hash in constant time */
+func (h Argon2idHasher) Matches(hash []byte, plaintext string) (bool, error) {
+	decoded, err := decodeArgon2id(hash)
+	if err != nil {
+		return false, err
+	}
+
+	p := decoded.params
+	key := argon2.IDKey([]byte(plaintext), decoded.salt, p.Iterations, p.Memory, p.Parallelism, uint32(len(decoded.key)))
+	return subtle.ConstantTimeCompare(key, decoded.key) == 1, nil
+}
+
+func (h Argon2idHasher) Owns(hash []byte) bool {
+	return bytes.HasPrefix(hash, []byte("$argon2id$"))
+}
+
+/* Report whether a hash was made with weaker or different parameters */
+func (h Argon2idHasher) NeedsRehash(hash []byte) bool {
+	decoded, err := decodeArgon2id(hash)
+	if err != nil {
+		return true
+	}
+
+	p := decoded.params
+	return p.Memory != h.Memory || p.Iterations != h.Iterations || p.Parallelism != h.Parallelism ||
+		uint32(len(decoded.salt)) != h.SaltLength || uint32(len(decoded.key)) != h.KeyLength
+}
+
+/* Parse the encoded argon2id format */
+func decodeArgon2id(hash []byte) (*argon2idHash, error) {
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, ErrUnknownHashFormat
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return nil, ErrUnknownHashFormat
+	}
+
+	var decoded argon2idHash
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &decoded.params.Memory, &decoded.params.Iterations, &decoded.params.Parallelism)
+	if err != nil {
+		return nil, ErrUnknownHashFormat
+	}
+
+	decoded.salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, ErrUnknownHashFormat
+	}
+	decoded.key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(decoded.key) == 0 {
+		return nil, ErrUnknownHashFormat
+	}
+	decoded.params.SaltLength = uint32(len(decoded.salt))
+	decoded.params.KeyLength = uint32(len(decoded.key))
+
+	return &decoded, nil
+}
+
+/* Longest password bcrypt can hash */
+const bcryptMaxLength = 72
+
+/* bcrypt, kept so existing hashes still verify */
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h BcryptHasher) Hash(plaintext string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(plaintext), h.Cost)
+}
+
+func (h BcryptHasher) Matches(hash []byte, plaintext string) (bool, error) {
+	// bcrypt only reads the first 72 bytes, so a longer guess would match a 72 byte password
+	// and then be saved as the new password when the hash is upgraded
+	if len(plaintext) > bcryptMaxLength {
+		return false, nil
+	}
+
+	err := bcrypt.CompareHashAndPassword(hash, []byte(plaintext))
+	if err != nil {
+		switch {
+		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func (h BcryptHasher) Owns(hash []byte) bool {
+	_, err := bcrypt.Cost(hash)
+	return err == nil
+}
+
+func (h BcryptHasher) NeedsRehash(hash []byte) bool {
+	cost, err := bcrypt.Cost(hash)
+	return err != nil || cost != h.Cost
+}
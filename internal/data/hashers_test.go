@@ -0,0 +1,205 @@
+package data
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestBcryptHasherRejectsLongPasswords(t *testing.T) {
+	original := strings.Repeat("x", bcryptMaxLength)
+	hash, err := bcrypt.GenerateFromPassword([]byte(original), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		plaintext string
+		want      bool
+	}{
+		{"exact", original, true},
+		{"one byte short", original[:bcryptMaxLength-1], false},
+		{"extra bytes", original + "EXTRA", false},
+		{"one extra byte", original + "x", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := BcryptHasher{Cost: 12}.Matches(hash, tt.plaintext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+/* Cheap parameters so the tests stay fast, DefaultHasher is only used where its parameters matter */
+var testArgon2id = Argon2idHasher{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+func TestArgon2idHasherRoundTrip(t *testing.T) {
+	for _, h := range []Argon2idHasher{testArgon2id, DefaultHasher.(Argon2idHasher)} {
+		hash, err := h.Hash("c0rrect-H0rse-b4ttery")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !h.Owns(hash) {
+			t.Errorf("hasher doesn't own its own hash %q", hash)
+		}
+
+		ok, err := h.Matches(hash, "c0rrect-H0rse-b4ttery")
+		if err != nil || !ok {
+			t.Errorf("correct password: got %t, %v", ok, err)
+		}
+		ok, err = h.Matches(hash, "c0rrect-H0rse-b4tter")
+		if err != nil || ok {
+			t.Errorf("wrong password: got %t, %v", ok, err)
+		}
+
+		// a fresh salt every time
+		again, err := h.Hash("c0rrect-H0rse-b4ttery")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(again) == string(hash) {
+			t.Error("two hashes of the same password are identical")
+		}
+	}
+}
+
+func TestDecodeArgon2idRejects(t *testing.T) {
+	hash, err := testArgon2id.Hash("c0rrect-H0rse-b4ttery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(string(hash), "$")
+	with := func(i int, value string) string {
+		changed := append([]string{}, parts...)
+		changed[i] = value
+		return strings.Join(changed, "$")
+	}
+
+	_, err = decodeArgon2id(hash)
+	if err != nil {
+		t.Fatalf("valid hash: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		hash string
+	}{
+		{"empty", ""},
+		{"bcrypt", "$2a$12$R9h/cIPz0gi.URNNX3kh2OPST9/PgBkqquzi.Ss7KIUgO2t0jWMUW"},
+		{"argon2i", with(1, "argon2i")},
+		{"old version", with(2, "v=16")},
+		{"missing version", with(2, "19")},
+		{"missing params", with(3, "m=1024,t=1")},
+		{"non numeric params", with(3, "m=lots,t=1,p=1")},
+		{"bad salt", with(4, "not base64!")},
+		{"bad key", with(5, "not base64!")},
+		{"empty key", with(5, "")},
+		{"extra section", string(hash) + "$extra"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decodeArgon2id([]byte(tt.hash))
+			if !errors.Is(err, ErrUnknownHashFormat) {
+				t.Errorf("got %v, want %v", err, ErrUnknownHashFormat)
+			}
+
+			ok, err := testArgon2id.Matches([]byte(tt.hash), "c0rrect-H0rse-b4ttery")
+			if ok || err == nil {
+				t.Errorf("Matches: got %t, %v", ok, err)
+			}
+		})
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	current, err := testArgon2id.Hash("c0rrect-H0rse-b4ttery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := bcrypt.GenerateFromPassword([]byte("c0rrect-H0rse-b4ttery"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := func(change func(h *Argon2idHasher)) []byte {
+		h := testArgon2id
+		change(&h)
+		hash, err := h.Hash("c0rrect-H0rse-b4ttery")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}
+
+	tests := []struct {
+		name string
+		hash []byte
+		want bool
+	}{
+		{"same params", current, false},
+		{"bcrypt", legacy, true},
+		{"memory", other(func(h *Argon2idHasher) { h.Memory = 2048 }), true},
+		{"iterations", other(func(h *Argon2idHasher) { h.Iterations = 2 }), true},
+		{"parallelism", other(func(h *Argon2idHasher) { h.Parallelism = 2 }), true},
+		{"salt length", other(func(h *Argon2idHasher) { h.SaltLength = 8 }), true},
+		{"key length", other(func(h *Argon2idHasher) { h.KeyLength = 16 }), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := testArgon2id.NeedsRehash(tt.hash)
+			if got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPasswordMatchesLegacyBcrypt(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("an-old-password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := password{hash: hash}
+
+	ok, err := p.Matches("an-old-password")
+	if err != nil || !ok {
+		t.Errorf("correct password: got %t, %v", ok, err)
+	}
+	ok, err = p.Matches("a-new-password")
+	if err != nil || ok {
+		t.Errorf("wrong password: got %t, %v", ok, err)
+	}
+	if !p.NeedsRehash() {
+		t.Error("bcrypt hash should need rehashing")
+	}
+
+	// once upgraded the password is stored with the default hasher and still matches
+	err = p.Set("an-old-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.NeedsRehash() || !DefaultHasher.Owns(p.hash) {
+		t.Errorf("upgraded hash %q should belong to the default hasher", p.hash)
+	}
+	ok, err = p.Matches("an-old-password")
+	if err != nil || !ok {
+		t.Errorf("upgraded password: got %t, %v", ok, err)
+	}
+
+	p = password{hash: []byte("plaintext-in-the-database")}
+	_, err = p.Matches("plaintext-in-the-database")
+	if !errors.Is(err, ErrUnknownHashFormat) {
+		t.Errorf("unknown format: got %v, want %v", err, ErrUnknownHashFormat)
+	}
+}
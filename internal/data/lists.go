@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/lib/pq"
 	"github.com/thats-insane/awt-test3/internal/validator"
 )
 
@@ -24,6 +25,12 @@ type BookList struct {
 	BookID int64 `json:"book_id"`
 }
 
+/* Public sort keys for lists and the columns they order by */
+var ListSortColumns = map[string]string{
+	"id":   "id",
+	"name": "name",
+}
+
 type ListModel struct {
 	DB *sql.DB
 }
@@ -46,17 +53,19 @@ func (l ListModel) Insert(list *List) error {
 
 /* Select all reading lists from database */
 func (l ListModel) GetAll(filters Filters) ([]*List, Metadata, error) {
+	keyset, limit, args := filters.page(1)
 	query := fmt.Sprintf(`
-		SELECT id, name, description, user_id, status
+		SELECT count(*) OVER(), %s, id, name, description, user_id, status
 		FROM lists
-		ORDER BY %s %s, id ASC
-		LIMIT $1 OFFSET $2
-	`, filters.sortColumn(), filters.sortDirection())
+		WHERE %s
+		ORDER BY %s
+		%s
+	`, filters.sortKeySelect(), keyset, filters.orderBy(), limit)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	rows, err := l.DB.QueryContext(ctx, query, filters.limit(), filters.offset())
+	rows, err := l.DB.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, Metadata{}, err
 	}
@@ -64,11 +73,12 @@ func (l ListModel) GetAll(filters Filters) ([]*List, Metadata, error) {
 	defer rows.Close()
 
 	var totalRecords int
+	var lastKeys []string
 	lists := []*List{}
 
 	for rows.Next() {
 		var list List
-		err := rows.Scan(&list.ID, &list.Name, &list.Desc, &list.UserID, &list.Status)
+		err := rows.Scan(&totalRecords, pq.Array(&lastKeys), &list.ID, &list.Name, &list.Desc, &list.UserID, &list.Status)
 		if err != nil {
 			return nil, Metadata{}, err
 		}
@@ -80,7 +90,11 @@ func (l ListModel) GetAll(filters Filters) ([]*List, Metadata, error) {
 		return nil, Metadata{}, err
 	}
 
-	metadata := calculateMetaData(totalRecords, filters.Page, filters.PageSize)
+	var lastID int64
+	if len(lists) > 0 {
+		lastID = lists[len(lists)-1].ID
+	}
+	metadata := filters.metadata(totalRecords, len(lists), lastKeys, lastID)
 
 	return lists, metadata, nil
 }
@@ -157,16 +171,47 @@ func (l ListModel) GetBooks(id int64) (*BookList, error) {
 	return &booklist, nil
 }
 
+/* IDs of the books in many reading lists in one query, keyed by list ID in the order they were added */
+func (l ListModel) GetBookIDs(listIDs []int64) (map[int64][]int64, error) {
+	query := `
+		SELECT list_id, book_id
+		FROM book_list
+		WHERE list_id = ANY($1)
+		ORDER BY id ASC
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := l.DB.QueryContext(ctx, query, pq.Array(listIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bookIDs := make(map[int64][]int64)
+	for rows.Next() {
+		var listID, bookID int64
+		err := rows.Scan(&listID, &bookID)
+		if err != nil {
+			return nil, err
+		}
+		bookIDs[listID] = append(bookIDs[listID], bookID)
+	}
+
+	return bookIDs, rows.Err()
+}
+
 /* Update a reading list's entry */
 func (l ListModel) Update(list *List) error {
 	query := `
-		UPDATE list
-		SET name = $1, description = $2, user_id = $3, status = $4
-		WHERE id = $5
+		UPDATE lists
+		SET name = $1, description = $2, status = $3
+		WHERE id = $4
 		RETURNING id
 	`
 
-	args := []any{list.Name, list.Desc, &list.UserID, &list.Status}
+	args := []any{list.Name, list.Desc, list.Status, list.ID}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
@@ -204,21 +249,21 @@ func (l ListModel) Delete(id int64) error {
 	return nil
 }
 
-/* Delete books from reading list */
-func (l ListModel) DeleteBook(id int64) error {
-	if id < 1 {
-		return nil
+/* Delete a book from a reading list */
+func (l ListModel) DeleteBook(listID int64, bookID int64) error {
+	if listID < 1 || bookID < 1 {
+		return ErrRecordNotFound
 	}
 
 	query := `
 		DELETE FROM book_list
-		WHERE book_id = $1
+		WHERE list_id = $1 AND book_id = $2
 	`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	result, err := l.DB.ExecContext(ctx, query, id)
+	result, err := l.DB.ExecContext(ctx, query, listID, bookID)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,139 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+/* Failed logins allowed before an account is locked, and how long the first lockout lasts */
+const MaxFailedLogins = 5
+const baseLockout = time.Minute
+const maxLockout = 24 * time.Hour
+
+type LoginAttempt struct {
+	UserID       int64
+	FailedCount  int
+	LastFailedAt time.Time
+	LockedUntil  *time.Time
+	NotifiedAt   *time.Time
+}
+
+type LoginAttemptModel struct {
+	DB *sql.DB
+}
+
+/* Check if the account is currently locked */
+func (l *LoginAttempt) IsLocked(now time.Time) bool {
+	return l.LockedUntil != nil && l.LockedUntil.After(now)
+}
+
+/* Lockout doubles with every failure past the limit, up to a maximum */
+func LockoutDuration(failedCount int) time.Duration {
+	if failedCount < MaxFailedLogins {
+		return 0
+	}
+
+	lockout := baseLockout
+	for i := MaxFailedLogins; i < failedCount; i++ {
+		lockout *= 2
+		if lockout >= maxLockout {
+			return maxLockout
+		}
+	}
+	return lockout
+}
+
+/* Select the failed login record for a user (an empty record if there are no failures) */
+func (l LoginAttemptModel) Get(userID int64) (*LoginAttempt, error) {
+	query := `
+		SELECT user_id, failed_count, last_failed_at, locked_until, notified_at
+		FROM login_attempts
+		WHERE user_id = $1
+	`
+
+	attempt := LoginAttempt{UserID: userID}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := l.DB.QueryRowContext(ctx, query, userID).Scan(&attempt.UserID, &attempt.FailedCount, &attempt.LastFailedAt, &attempt.LockedUntil, &attempt.NotifiedAt)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	return &attempt, nil
+}
+
+/* Record a failed login and lock the account once there are too many */
+func (l LoginAttemptModel) RecordFailure(userID int64) (*LoginAttempt, error) {
+	// failures older than a day are forgotten
+	query := `
+		INSERT INTO login_attempts (user_id, failed_count, last_failed_at)
+		VALUES ($1, 1, NOW())
+		ON CONFLICT (user_id) DO UPDATE
+		SET failed_count = CASE
+				WHEN login_attempts.last_failed_at < NOW() - INTERVAL '24 hours' THEN 1
+				ELSE login_attempts.failed_count + 1
+			END,
+			last_failed_at = NOW()
+		RETURNING user_id, failed_count, last_failed_at, notified_at
+	`
+
+	var attempt LoginAttempt
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := l.DB.QueryRowContext(ctx, query, userID).Scan(&attempt.UserID, &attempt.FailedCount, &attempt.LastFailedAt, &attempt.NotifiedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	lockout := LockoutDuration(attempt.FailedCount)
+	if lockout == 0 {
+		return &attempt, nil
+	}
+
+	lockedUntil := attempt.LastFailedAt.Add(lockout)
+	attempt.LockedUntil = &lockedUntil
+
+	query = `
+		UPDATE login_attempts
+		SET locked_until = $1
+		WHERE user_id = $2
+	`
+
+	_, err = l.DB.ExecContext(ctx, query, lockedUntil, userID)
+	if err != nil {
+		return nil, err
+	}
+	return &attempt, nil
+}
+
+/* Record that the user was emailed about failed logins */
+func (l LoginAttemptModel) MarkNotified(userID int64) error {
+	query := `
+		UPDATE login_attempts
+		SET notified_at = NOW()
+		WHERE user_id = $1
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := l.DB.ExecContext(ctx, query, userID)
+	return err
+}
+
+/* Clear all failed logins for a user, unlocking their account */
+func (l LoginAttemptModel) Reset(userID int64) error {
+	query := `
+		DELETE FROM login_attempts
+		WHERE user_id = $1
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := l.DB.ExecContext(ctx, query, userID)
+	return err
+}
@@ -0,0 +1,253 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/thats-insane/awt-test3/internal/validator"
+)
+
+const ScopeOAuthAccess = "oauth-access"
+
+type OAuthClient struct {
+	ID           string    `json:"client_id"`
+	Secret       string    `json:"client_secret,omitempty"`
+	SecretHash   []byte    `json:"-"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Confidential bool      `json:"confidential"`
+	UserID       int64     `json:"-"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type OAuthCode struct {
+	Plaintext     string
+	Hash          []byte
+	ClientID      string
+	UserID        int64
+	RedirectURI   string
+	Scopes        []string
+	CodeChallenge string
+	Expiry        time.Time
+}
+
+type OAuthModel struct {
+	DB *sql.DB
+}
+
+/* Check if a redirect URI was registered for this client (exact match only) */
+func (c *OAuthClient) HasRedirectURI(uri string) bool {
+	return slices.Contains(c.RedirectURIs, uri)
+}
+
+/* Check a client secret, public clients have no secret and rely on PKCE alone */
+func (c *OAuthClient) SecretMatches(secret string) bool {
+	if !c.Confidential {
+		return true
+	}
+	return subtle.ConstantTimeCompare(c.SecretHash, HashTokenPlaintext(secret)) == 1
+}
+
+/* Check a PKCE code verifier against the S256 challenge sent to /oauth/authorize */
+func (c *OAuthCode) VerifierMatches(verifier string) bool {
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(challenge), []byte(c.CodeChallenge)) == 1
+}
+
+func randomString(length int) (string, error) {
+	randomBytes := make([]byte, length)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(randomBytes), nil
+}
+
+/* Register a new client, confidential clients also get a secret that is only returned here */
+func (o OAuthModel) InsertClient(client *OAuthClient) error {
+	var err error
+	client.ID, err = randomString(16)
+	if err != nil {
+		return err
+	}
+
+	if client.Confidential {
+		client.Secret, err = randomString(32)
+		if err != nil {
+			return err
+		}
+		client.SecretHash = HashTokenPlaintext(client.Secret)
+	}
+
+	query := `
+		INSERT INTO oauth_clients (id, secret_hash, name, redirect_uris, user_id)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING created_at
+	`
+
+	args := []any{client.ID, client.SecretHash, client.Name, pq.Array(client.RedirectURIs), client.UserID}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return o.DB.QueryRowContext(ctx, query, args...).Scan(&client.CreatedAt)
+}
+
+/* Select a client by its client_id */
+func (o OAuthModel) GetClient(id string) (*OAuthClient, error) {
+	query := `
+		SELECT id, secret_hash, name, redirect_uris, user_id, created_at
+		FROM oauth_clients
+		WHERE id = $1
+	`
+
+	var client OAuthClient
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := o.DB.QueryRowContext(ctx, query, id).Scan(&client.ID, &client.SecretHash, &client.Name, pq.Array(&client.RedirectURIs), &client.UserID, &client.CreatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	client.Confidential = client.SecretHash != nil
+	return &client, nil
+}
+
+/* Create a single use authorization code */
+func (o OAuthModel) NewCode(code *OAuthCode, ttl time.Duration) error {
+	var err error
+	code.Plaintext, err = randomString(32)
+	if err != nil {
+		return err
+	}
+	code.Hash = HashTokenPlaintext(code.Plaintext)
+	code.Expiry = time.Now().Add(ttl)
+
+	query := `
+		INSERT INTO oauth_codes (hash, client_id, user_id, redirect_uri, scopes, code_challenge, expiry)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`
+
+	args := []any{code.Hash, code.ClientID, code.UserID, code.RedirectURI, pq.Array(code.Scopes), code.CodeChallenge, code.Expiry}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err = o.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+/* Delete and return an unexpired authorization code so it can only ever be exchanged once */
+func (o OAuthModel) ConsumeCode(plaintext string) (*OAuthCode, error) {
+	query := `
+		DELETE FROM oauth_codes
+		WHERE hash = $1
+		RETURNING hash, client_id, user_id, redirect_uri, scopes, code_challenge, expiry
+	`
+
+	var code OAuthCode
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := o.DB.QueryRowContext(ctx, query, HashTokenPlaintext(plaintext)).Scan(&code.Hash, &code.ClientID, &code.UserID, &code.RedirectURI, pq.Array(&code.Scopes), &code.CodeChallenge, &code.Expiry)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if time.Now().After(code.Expiry) {
+		return nil, ErrRecordNotFound
+	}
+	return &code, nil
+}
+
+/* Create an access token a client can use on behalf of a user, limited to the granted scopes */
+func (o OAuthModel) NewAccessToken(userID int64, clientID string, scopes []string, ttl time.Duration) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeOAuthAccess)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		INSERT INTO tokens (hash, user_id, created_at, expiry, scope, client_id, grants)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`
+
+	args := []any{token.Hash, token.UserID, token.CreatedAt, token.Expiry, token.Scope, clientID, pq.Array(scopes)}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err = o.DB.ExecContext(ctx, query, args...)
+	return token, err
+}
+
+/* Select the user and granted scopes for an unexpired OAuth access token */
+func (o OAuthModel) GetForAccessToken(plaintext string) (*User, []string, error) {
+	query := `
+		SELECT users.id, users.created_at, users.username, users.email, users.password, users.activated, users.admin, users.version, tokens.grants
+		FROM users
+		INNER JOIN tokens
+		ON users.id = tokens.user_id
+		WHERE tokens.hash = $1
+		AND tokens.scope = $2
+		AND tokens.expiry > $3
+	`
+
+	args := []any{HashTokenPlaintext(plaintext), ScopeOAuthAccess, time.Now()}
+	var user User
+	var scopes []string
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := o.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Username, &user.Email, &user.Password.hash, &user.Activated, &user.Admin, &user.Version, pq.Array(&scopes))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	// never hand back nil, that would mean the token is unrestricted
+	if scopes == nil {
+		scopes = []string{}
+	}
+	return &user, scopes, nil
+}
+
+/* Validation for client registration */
+func ValidateOAuthClient(v *validator.Validator, client *OAuthClient) {
+	v.Check(client.Name != "", "name", "must be provided")
+	v.Check(len(client.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(len(client.RedirectURIs) > 0, "redirect_uris", "must contain at least one URI")
+	for _, uri := range client.RedirectURIs {
+		parsed, err := url.Parse(uri)
+		v.Check(err == nil && parsed.IsAbs() && parsed.Fragment == "", "redirect_uris", "must only contain absolute URIs without a fragment")
+	}
+}
+
+/* Validation for a PKCE code verifier (RFC 7636 section 4.1) */
+func ValidateCodeVerifier(v *validator.Validator, verifier string) {
+	v.Check(len(verifier) >= 43 && len(verifier) <= 128, "code_verifier", "must be between 43 and 128 characters")
+}
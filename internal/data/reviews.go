@@ -7,16 +7,26 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/lib/pq"
 	"github.com/thats-insane/awt-test3/internal/validator"
 )
 
 type Review struct {
-	ID        int64     `json:"id"`
-	BookID    int64     `json:"book_id"`
-	UserID    int64     `json:"user_id"`
-	Rating    int64     `json:"rating"`
-	Desc      string    `json:"description"`
-	CreatedAt time.Time `json:"-"`
+	ID           int64     `json:"id"`
+	BookID       int64     `json:"book_id"`
+	UserID       int64     `json:"user_id"`
+	Rating       int64     `json:"rating"`
+	Desc         string    `json:"description"`
+	HelpfulCount int       `json:"helpful_count"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+/* Public sort keys for reviews and the columns they order by */
+var ReviewSortColumns = map[string]string{
+	"id":            "id",
+	"rating":        "rating",
+	"created_at":    "created_at",
+	"helpful_count": "helpful_count",
 }
 
 type ReviewModel struct {
@@ -35,7 +45,7 @@ func (r ReviewModel) Insert(review *Review) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	return r.DB.QueryRowContext(ctx, query, args...).Scan(&review.ID)
+	return r.DB.QueryRowContext(ctx, query, args...).Scan(&review.ID, &review.CreatedAt)
 }
 
 /* Select a review */
@@ -44,7 +54,7 @@ func (r ReviewModel) Get(id int64) (*Review, error) {
 		return nil, ErrRecordNotFound
 	}
 	query := `
-		SELECT id, book_id, user_id, rating, description
+		SELECT id, book_id, user_id, rating, description, helpful_count, created_at
 		FROM reviews
 		WHERE id = $1
 	`
@@ -52,7 +62,7 @@ func (r ReviewModel) Get(id int64) (*Review, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := r.DB.QueryRowContext(ctx, query, id).Scan(&review.ID, &review.BookID, &review.UserID, &review.Rating, &review.Desc, &review.CreatedAt)
+	err := r.DB.QueryRowContext(ctx, query, id).Scan(&review.ID, &review.BookID, &review.UserID, &review.Rating, &review.Desc, &review.HelpfulCount, &review.CreatedAt)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, ErrRecordNotFound
@@ -68,7 +78,7 @@ func (r ReviewModel) GetUser(id int64) ([]*Review, error) {
 		return nil, ErrRecordNotFound
 	}
 	query := `
-		SELECT id, book_id, user_id, rating, description
+		SELECT id, book_id, user_id, rating, description, helpful_count, created_at
 		FROM reviews
 		WHERE user_id = $1
 	`
@@ -85,7 +95,7 @@ func (r ReviewModel) GetUser(id int64) ([]*Review, error) {
 	reviews := []*Review{}
 	for rows.Next() {
 		var review Review
-		err := rows.Scan(&review.ID, &review.BookID, &review.UserID, &review.Rating, &review.Desc, &review.CreatedAt)
+		err := rows.Scan(&review.ID, &review.BookID, &review.UserID, &review.Rating, &review.Desc, &review.HelpfulCount, &review.CreatedAt)
 		if err != nil {
 			return nil, err
 		}
@@ -102,28 +112,80 @@ func (r ReviewModel) GetUser(id int64) ([]*Review, error) {
 
 /* Select all reviews */
 func (r ReviewModel) GetAll(filters Filters) ([]*Review, Metadata, error) {
+	keyset, limit, args := filters.page(1)
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), %s, id, book_id, user_id, rating, description, helpful_count, created_at
+		FROM reviews
+		WHERE %s
+		ORDER BY %s
+		%s
+	`, filters.sortKeySelect(), keyset, filters.orderBy(), limit)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := r.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	var totalRecords int
+	var lastKeys []string
+	reviews := []*Review{}
+
+	for rows.Next() {
+		var review Review
+		err := rows.Scan(&totalRecords, pq.Array(&lastKeys), &review.ID, &review.BookID, &review.UserID, &review.Rating, &review.Desc, &review.HelpfulCount, &review.CreatedAt)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		reviews = append(reviews, &review)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	var lastID int64
+	if len(reviews) > 0 {
+		lastID = reviews[len(reviews)-1].ID
+	}
+	metadata := filters.metadata(totalRecords, len(reviews), lastKeys, lastID)
+
+	return reviews, metadata, nil
+}
+
+/* Select the reviews of one book */
+func (r ReviewModel) GetForBook(bookID int64, filters Filters) ([]*Review, Metadata, error) {
+	keyset, limit, pageArgs := filters.page(2)
 	query := fmt.Sprintf(`
-		SELECT id, book_id, user_id, rating, description
+		SELECT count(*) OVER(), %s, id, book_id, user_id, rating, description, helpful_count, created_at
 		FROM reviews
-		ORDER BY %s %s, id ASC
-		LIMIT $1 OFFSET $2
-	`, filters.sortColumn(), filters.sortDirection())
+		WHERE book_id = $1
+		AND %s
+		ORDER BY %s
+		%s
+	`, filters.sortKeySelect(), keyset, filters.orderBy(), limit)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	rows, err := r.DB.QueryContext(ctx, query, filters.limit(), filters.offset())
+	args := append([]any{bookID}, pageArgs...)
+	rows, err := r.DB.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, Metadata{}, err
 	}
 	defer rows.Close()
 
 	var totalRecords int
+	var lastKeys []string
 	reviews := []*Review{}
 
 	for rows.Next() {
 		var review Review
-		err := rows.Scan(&totalRecords, &review.ID, &review.BookID, &review.UserID, &review.Rating, &review.Desc, &review.CreatedAt)
+		err := rows.Scan(&totalRecords, pq.Array(&lastKeys), &review.ID, &review.BookID, &review.UserID, &review.Rating, &review.Desc, &review.HelpfulCount, &review.CreatedAt)
 		if err != nil {
 			return nil, Metadata{}, err
 		}
@@ -135,11 +197,76 @@ func (r ReviewModel) GetAll(filters Filters) ([]*Review, Metadata, error) {
 		return nil, Metadata{}, err
 	}
 
-	metadata := calculateMetaData(totalRecords, filters.Page, filters.PageSize)
+	var lastID int64
+	if len(reviews) > 0 {
+		lastID = reviews[len(reviews)-1].ID
+	}
+	metadata := filters.metadata(totalRecords, len(reviews), lastKeys, lastID)
 
 	return reviews, metadata, nil
 }
 
+/* Count the reviews of a book per star rating, every star from 1 to 5 is present */
+func (r ReviewModel) RatingHistogram(bookID int64) (map[int64]int, error) {
+	query := `
+		SELECT rating, count(*)
+		FROM reviews
+		WHERE book_id = $1
+		GROUP BY rating
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := r.DB.QueryContext(ctx, query, bookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	histogram := map[int64]int{1: 0, 2: 0, 3: 0, 4: 0, 5: 0}
+	for rows.Next() {
+		var rating int64
+		var count int
+		err := rows.Scan(&rating, &count)
+		if err != nil {
+			return nil, err
+		}
+		histogram[rating] = count
+	}
+
+	return histogram, rows.Err()
+}
+
+/* Mark a review as helpful; voting twice has no extra effect */
+func (r ReviewModel) AddVote(reviewID int64, userID int64) error {
+	query := `
+		INSERT INTO review_votes (review_id, user_id)
+		VALUES ($1, $2)
+		ON CONFLICT DO NOTHING
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := r.DB.ExecContext(ctx, query, reviewID, userID)
+	return err
+}
+
+/* Withdraw a helpful vote */
+func (r ReviewModel) RemoveVote(reviewID int64, userID int64) error {
+	query := `
+		DELETE FROM review_votes
+		WHERE review_id = $1 AND user_id = $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := r.DB.ExecContext(ctx, query, reviewID, userID)
+	return err
+}
+
 /* Update a review */
 func (r ReviewModel) Update(review *Review) error {
 	query := `
@@ -153,7 +280,7 @@ func (r ReviewModel) Update(review *Review) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	return r.DB.QueryRowContext(ctx, query, args...).Scan(&review.ID)
+	return r.DB.QueryRowContext(ctx, query, args...).Scan(&review.ID, &review.CreatedAt)
 }
 
 /* Delete a review */
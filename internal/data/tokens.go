@@ -6,6 +6,7 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"errors"
 	"time"
 
 	"github.com/thats-insane/awt-test3/internal/validator"
@@ -13,13 +14,21 @@ import (
 
 const ScopeActivation = "activation"
 const ScopeAuthentication = "authentication"
+const ScopePasswordReset = "password-reset"
+const ScopeRefresh = "refresh"
+const ScopeEmailChange = "email-change"
+const ScopeTwoFactorPending = "two-factor-pending"
 
 type Token struct {
-	Plaintext string
-	Hash      []byte
-	UserID    int64
-	Expiry    time.Time
-	Scope     string
+	Plaintext  string     `json:"token,omitempty"`
+	Hash       []byte     `json:"-"`
+	UserID     int64      `json:"-"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Expiry     time.Time  `json:"expiry"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Scope      string     `json:"-"`
+	Family     []byte     `json:"-"`
+	UsedAt     *time.Time `json:"-"`
 }
 
 type TokenModel struct {
@@ -29,9 +38,10 @@ type TokenModel struct {
 /* Generate authentication token */
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
 	token := &Token{
-		UserID: userID,
-		Expiry: time.Now().Add(ttl),
-		Scope:  scope,
+		UserID:    userID,
+		CreatedAt: time.Now(),
+		Expiry:    time.Now().Add(ttl),
+		Scope:     scope,
 	}
 
 	// create a byte slice and fill with random values for our token
@@ -43,12 +53,17 @@ func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error
 
 	// encode and hash token
 	token.Plaintext = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
-	hash := sha256.Sum256([]byte(token.Plaintext))
-	token.Hash = hash[:]
+	token.Hash = HashTokenPlaintext(token.Plaintext)
 
 	return token, nil
 }
 
+/* Hash a plaintext token the same way it is stored in the database */
+func HashTokenPlaintext(plaintext string) []byte {
+	hash := sha256.Sum256([]byte(plaintext))
+	return hash[:]
+}
+
 /* Validate that token exists and is of appropriate length */
 func ValidateTokenPlaintext(v *validator.Validator, plaintext string) {
 	v.Check(plaintext != "", "token", "must be provided")
@@ -66,14 +81,36 @@ func (t TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token,
 	return token, err
 }
 
+/* Create a new token that belongs to a token family (all tokens issued from one login) */
+func (t TokenModel) NewInFamily(userID int64, ttl time.Duration, scope string, family []byte) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	token.Family = family
+	err = t.Insert(token)
+	return token, err
+}
+
+/* Generate a random identifier for a new token family */
+func NewTokenFamily() ([]byte, error) {
+	family := make([]byte, 16)
+	_, err := rand.Read(family)
+	if err != nil {
+		return nil, err
+	}
+	return family, nil
+}
+
 /* Insert a token into the database */
 func (t TokenModel) Insert(token *Token) error {
 	query := `
-		INSERT INTO tokens (hash, user_id, expiry, scope) 
-        VALUES ($1, $2, $3, $4)
+		INSERT INTO tokens (hash, user_id, created_at, expiry, scope, family) 
+        VALUES ($1, $2, $3, $4, $5, $6)
 	`
 
-	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope}
+	args := []any{token.Hash, token.UserID, token.CreatedAt, token.Expiry, token.Scope, token.Family}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -95,3 +132,167 @@ func (t TokenModel) DeleteAllForUser(scope string, userID int64) error {
 	_, err := t.DB.ExecContext(ctx, query, scope, userID)
 	return err
 }
+
+/* Delete every session of a user (authentication and refresh tokens) except the one the hash belongs to */
+func (t TokenModel) DeleteOtherSessions(userID int64, hash []byte) error {
+	query := `
+		DELETE FROM tokens
+		WHERE user_id = $1
+		AND scope IN ($2, $3)
+		AND hash <> $4
+		AND (family IS NULL OR family IS DISTINCT FROM (SELECT family FROM tokens WHERE hash = $4))
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := t.DB.ExecContext(ctx, query, userID, ScopeAuthentication, ScopeRefresh, hash)
+	return err
+}
+
+/* Delete a single token along with the rest of its family */
+func (t TokenModel) DeleteByHash(hash []byte) error {
+	query := `
+		DELETE FROM tokens
+		WHERE hash = $1
+		OR family = (SELECT family FROM tokens WHERE hash = $1)
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := t.DB.ExecContext(ctx, query, hash)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+/* Select all unexpired tokens of one scope for a user */
+func (t TokenModel) GetAllForUser(scope string, userID int64) ([]*Token, error) {
+	query := `
+		SELECT hash, user_id, created_at, expiry, last_used_at, scope
+		FROM tokens
+		WHERE scope = $1 AND user_id = $2 AND expiry > $3
+		ORDER BY created_at DESC
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := t.DB.QueryContext(ctx, query, scope, userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []*Token{}
+
+	for rows.Next() {
+		var token Token
+		err := rows.Scan(&token.Hash, &token.UserID, &token.CreatedAt, &token.Expiry, &token.LastUsedAt, &token.Scope)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, &token)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+/* Record that a token was just used (at most once a minute to limit writes) */
+func (t TokenModel) UpdateLastUsed(hash []byte) error {
+	query := `
+		UPDATE tokens
+		SET last_used_at = NOW()
+		WHERE hash = $1
+		AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := t.DB.ExecContext(ctx, query, hash)
+	return err
+}
+
+/* Select an unexpired refresh token, including ones that have already been used */
+func (t TokenModel) GetRefresh(plaintext string) (*Token, error) {
+	query := `
+		SELECT hash, user_id, created_at, expiry, scope, family, used_at
+		FROM tokens
+		WHERE hash = $1 AND scope = $2 AND expiry > $3
+	`
+
+	args := []any{HashTokenPlaintext(plaintext), ScopeRefresh, time.Now()}
+	var token Token
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := t.DB.QueryRowContext(ctx, query, args...).Scan(&token.Hash, &token.UserID, &token.CreatedAt, &token.Expiry, &token.Scope, &token.Family, &token.UsedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &token, nil
+}
+
+/* Mark a token as used, fails with ErrTokenReused if it was already used */
+func (t TokenModel) MarkUsed(hash []byte) error {
+	query := `
+		UPDATE tokens
+		SET used_at = NOW()
+		WHERE hash = $1 AND used_at IS NULL
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := t.DB.ExecContext(ctx, query, hash)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrTokenReused
+	}
+
+	return nil
+}
+
+/* Delete every token in a family */
+func (t TokenModel) DeleteFamily(family []byte) error {
+	query := `
+		DELETE FROM tokens
+		WHERE family = $1
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := t.DB.ExecContext(ctx, query, family)
+	return err
+}
@@ -0,0 +1,195 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"time"
+
+	"github.com/thats-insane/awt-test3/internal/validator"
+)
+
+/* Number of single use recovery codes given out when 2FA is enabled */
+const recoveryCodeCount = 10
+
+type TwoFactor struct {
+	UserID       int64
+	Secret       string
+	Confirmed    bool
+	LastUsedStep int64
+	CreatedAt    time.Time
+}
+
+type TwoFactorModel struct {
+	DB *sql.DB
+}
+
+/* Select a user's TOTP settings */
+func (t TwoFactorModel) Get(userID int64) (*TwoFactor, error) {
+	query := `
+		SELECT user_id, secret, confirmed, last_used_step, created_at
+		FROM two_factor
+		WHERE user_id = $1
+	`
+
+	var twoFactor TwoFactor
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := t.DB.QueryRowContext(ctx, query, userID).Scan(&twoFactor.UserID, &twoFactor.Secret, &twoFactor.Confirmed, &twoFactor.LastUsedStep, &twoFactor.CreatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &twoFactor, nil
+}
+
+/* Start (or restart) enrollment with a new unconfirmed secret */
+func (t TwoFactorModel) Enroll(userID int64, secret string) error {
+	query := `
+		INSERT INTO two_factor (user_id, secret)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET secret = EXCLUDED.secret, confirmed = false, last_used_step = 0, created_at = NOW()
+		WHERE two_factor.confirmed = false
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := t.DB.ExecContext(ctx, query, userID, secret)
+	return err
+}
+
+/* Turn on 2FA once the user has proven their authenticator works */
+func (t TwoFactorModel) Confirm(userID int64, step int64) error {
+	query := `
+		UPDATE two_factor
+		SET confirmed = true, last_used_step = $2
+		WHERE user_id = $1
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := t.DB.ExecContext(ctx, query, userID, step)
+	return err
+}
+
+/* Record the time step of an accepted code, fails with ErrCodeReused if that code was already used */
+func (t TwoFactorModel) UseStep(userID int64, step int64) error {
+	query := `
+		UPDATE two_factor
+		SET last_used_step = $2
+		WHERE user_id = $1 AND last_used_step < $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := t.DB.ExecContext(ctx, query, userID, step)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrCodeReused
+	}
+
+	return nil
+}
+
+/* Turn off 2FA and remove the recovery codes */
+func (t TwoFactorModel) Delete(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := t.DB.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = t.DB.ExecContext(ctx, `DELETE FROM two_factor WHERE user_id = $1`, userID)
+	return err
+}
+
+/* Replace a user's recovery codes, only the hashes are stored so the plaintext is returned once */
+func (t TwoFactorModel) NewRecoveryCodes(userID int64) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := t.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		randomBytes := make([]byte, 10)
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+
+		_, err = tx.ExecContext(ctx, `INSERT INTO recovery_codes (hash, user_id) VALUES ($1, $2)`, HashTokenPlaintext(codes[i]), userID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return codes, tx.Commit()
+}
+
+/* Use up a recovery code */
+func (t TwoFactorModel) UseRecoveryCode(userID int64, code string) error {
+	query := `
+		DELETE FROM recovery_codes
+		WHERE hash = $1 AND user_id = $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := t.DB.ExecContext(ctx, query, HashTokenPlaintext(code), userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+/* Validate that a TOTP code or recovery code was provided */
+func ValidateTwoFactorCode(v *validator.Validator, code string, recoveryCode string) {
+	v.Check(code != "" || recoveryCode != "", "code", "must be provided")
+	if code != "" {
+		v.Check(len(code) == 6, "code", "must be 6 digits")
+	}
+	if recoveryCode != "" {
+		v.Check(len(recoveryCode) == 16, "recovery_code", "must be 16 bytes")
+	}
+}
@@ -2,17 +2,20 @@ package data
 
 import (
 	"context"
-	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"fmt"
 	"time"
 
+	"github.com/lib/pq"
 	"github.com/thats-insane/awt-test3/internal/validator"
-	"golang.org/x/crypto/bcrypt"
 )
 
 var AnonUser = &User{}
 
+const DeleteModeAnonymise = "anonymise"
+const DeleteModeHard = "delete"
+
 type User struct {
 	ID        int64     `json:"id"`
 	CreatedAt time.Time `json:"created_at"`
@@ -20,9 +23,17 @@ type User struct {
 	Email     string    `json:"email"`
 	Password  password  `json:"-"`
 	Activated bool      `json:"activated"`
+	Admin     bool      `json:"-"`
 	Version   int       `json:"-"`
 }
 
+/* What other members may see of a user, never the email */
+type UserProfile struct {
+	ID        int64     `json:"id"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
 type password struct {
 	plaintext *string
 	hash      []byte
@@ -37,8 +48,8 @@ func (u *User) IsAnon() bool {
 	return u == AnonUser
 }
 
-/* Insert a user into the database */
-func (u UserModel) Insert(user *User) error {
+/* Insert a user and grant their permissions in one transaction, so an account never exists without them */
+func (u UserModel) Insert(user *User, permissions ...string) error {
 	query := `
 		INSERT INTO users (username, email, password, activated)
 		VALUES ($1, $2, $3, $4)
@@ -49,7 +60,13 @@ func (u UserModel) Insert(user *User) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := u.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+	tx, err := u.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
 	if err != nil {
 		switch {
 		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
@@ -58,13 +75,26 @@ func (u UserModel) Insert(user *User) error {
 			return err
 		}
 	}
-	return nil
+
+	if len(permissions) > 0 {
+		query = `
+			INSERT INTO users_permissions
+			SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+		`
+
+		_, err = tx.ExecContext(ctx, query, user.ID, pq.Array(permissions))
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
 }
 
 /* Select a user based on their ID */
 func (u UserModel) Get(id int64) (*User, error) {
 	query := `
-		SELECT id, created_at, username, email, password, activated, version
+		SELECT id, created_at, username, email, password, activated, admin, version
 		FROM users
 		WHERE id = $1
 	`
@@ -73,7 +103,7 @@ func (u UserModel) Get(id int64) (*User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := u.DB.QueryRowContext(ctx, query, id).Scan(&user.ID, &user.CreatedAt, &user.Username, &user.Email, &user.Password.hash, &user.Activated, &user.Version)
+	err := u.DB.QueryRowContext(ctx, query, id).Scan(&user.ID, &user.CreatedAt, &user.Username, &user.Email, &user.Password.hash, &user.Activated, &user.Admin, &user.Version)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -112,9 +142,44 @@ func (u UserModel) Update(user *User) error {
 	return nil
 }
 
+/* Public profile of the user */
+func (u *User) Profile() *UserProfile {
+	return &UserProfile{ID: u.ID, Username: u.Username, CreatedAt: u.CreatedAt}
+}
+
+/* Fetch the public profiles of many users in one query, keyed by user ID */
+func (u UserModel) GetProfiles(ids []int64) (map[int64]*UserProfile, error) {
+	query := `
+		SELECT id, username, created_at
+		FROM users
+		WHERE id = ANY($1)
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := u.DB.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	profiles := make(map[int64]*UserProfile)
+	for rows.Next() {
+		var profile UserProfile
+		err := rows.Scan(&profile.ID, &profile.Username, &profile.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		profiles[profile.ID] = &profile
+	}
+
+	return profiles, rows.Err()
+}
+
 /* Hashes the password */
 func (p *password) Set(plaintext string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(plaintext), 12)
+	hash, err := DefaultHasher.Hash(plaintext)
 	if err != nil {
 		return err
 	}
@@ -126,17 +191,17 @@ func (p *password) Set(plaintext string) error {
 
 /* Authenticates password */
 func (p *password) Matches(plaintext string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword(p.hash, []byte(plaintext))
+	hasher, err := hasherFor(p.hash)
 	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			return false, nil
-		default:
-			return false, err
-		}
+		return false, err
 	}
 
-	return true, nil
+	return hasher.Matches(p.hash, plaintext)
+}
+
+/* Check if the stored hash should be replaced with one from the default hasher */
+func (p *password) NeedsRehash() bool {
+	return !DefaultHasher.Owns(p.hash) || DefaultHasher.NeedsRehash(p.hash)
 }
 
 /* Validation for email, password and user */
@@ -149,7 +214,15 @@ func ValidateEmail(v *validator.Validator, email string) {
 func ValidatePasswordPlaintext(v *validator.Validator, password string) {
 	v.Check(password != "", "password", "must be provided")
 	v.Check(len(password) >= 8, "password", "must be at least 8 bytes")
-	v.Check(len(password) <= 72, "password", "must be less than 72 bytes")
+	v.Check(len(password) <= 500, "password", "must be less than 500 bytes")
+}
+
+/* Strength rules for a password being set, on top of the basic length checks */
+func ValidateNewPassword(v *validator.Validator, password string, details ...string) {
+	ValidatePasswordPlaintext(v, password)
+	v.Check(!validator.ContainsPersonalInfo(password, details...), "password_personal_info", "must not contain your username or email")
+	v.Check(!validator.BreachedPasswords.Contains(password), "password_breached", "has appeared in a data breach, choose a different one")
+	v.Check(validator.PasswordEntropy(password) >= validator.MinPasswordEntropy, "password_entropy", "is too easy to guess, make it longer or mix in upper case letters, numbers and symbols")
 }
 
 /* Validation for email, password and user */
@@ -159,7 +232,7 @@ func ValidateUser(v *validator.Validator, user *User) {
 	ValidateEmail(v, user.Email)
 
 	if user.Password.plaintext != nil {
-		ValidatePasswordPlaintext(v, *user.Password.plaintext)
+		ValidateNewPassword(v, *user.Password.plaintext, user.Username, user.Email)
 	}
 	if user.Password.hash == nil {
 		panic("missing password hash")
@@ -168,9 +241,9 @@ func ValidateUser(v *validator.Validator, user *User) {
 
 /* Select a user (for token) */
 func (u UserModel) GetForToken(scope string, plaintext string) (*User, error) {
-	hash := sha256.Sum256([]byte(plaintext))
+	hash := HashTokenPlaintext(plaintext)
 	query := `
-		SELECT users.id, users.created_at, users.username, users.email, users.password, users.activated, users.version
+		SELECT users.id, users.created_at, users.username, users.email, users.password, users.activated, users.admin, users.version
         FROM users
         INNER JOIN tokens
         ON users.id = tokens.user_id
@@ -179,13 +252,13 @@ func (u UserModel) GetForToken(scope string, plaintext string) (*User, error) {
         AND tokens.expiry > $3
 	`
 
-	args := []any{hash[:], scope, time.Now()}
+	args := []any{hash, scope, time.Now()}
 	var user User
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := u.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Username, &user.Email, &user.Password.hash, &user.Activated, &user.Version)
+	err := u.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Username, &user.Email, &user.Password.hash, &user.Activated, &user.Admin, &user.Version)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -199,7 +272,7 @@ func (u UserModel) GetForToken(scope string, plaintext string) (*User, error) {
 
 func (u UserModel) GetByEmail(email string) (*User, error) {
 	query := `
-		SELECT id, created_at, username, email, password, activated, version
+		SELECT id, created_at, username, email, password, activated, admin, version
 		FROM users
 		WHERE email = $1
    `
@@ -208,7 +281,7 @@ func (u UserModel) GetByEmail(email string) (*User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := u.DB.QueryRowContext(ctx, query, email).Scan(&user.ID, &user.CreatedAt, &user.Username, &user.Email, &user.Password.hash, &user.Activated, &user.Version)
+	err := u.DB.QueryRowContext(ctx, query, email).Scan(&user.ID, &user.CreatedAt, &user.Username, &user.Email, &user.Password.hash, &user.Activated, &user.Admin, &user.Version)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -220,3 +293,123 @@ func (u UserModel) GetByEmail(email string) (*User, error) {
 
 	return &user, nil
 }
+
+/* Delete a user and their data in one transaction, anonymising keeps their reviews under a "deleted user" account */
+func (u UserModel) Delete(id int64, mode string) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := u.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// reading lists and sessions are personal, so they go in both modes
+	queries := []string{
+		`DELETE FROM book_list WHERE list_id IN (SELECT id FROM lists WHERE user_id = $1)`,
+		`DELETE FROM lists WHERE user_id = $1`,
+		`DELETE FROM tokens WHERE user_id = $1`,
+	}
+
+	switch mode {
+	case DeleteModeAnonymise:
+		queries = append(queries,
+			`DELETE FROM users_permissions WHERE user_id = $1`,
+			`DELETE FROM email_changes WHERE user_id = $1`,
+			`DELETE FROM login_attempts WHERE user_id = $1`,
+			`DELETE FROM recovery_codes WHERE user_id = $1`,
+			`DELETE FROM two_factor WHERE user_id = $1`,
+			`DELETE FROM api_keys WHERE user_id = $1`,
+			`DELETE FROM oauth_codes WHERE user_id = $1`,
+			`DELETE FROM oauth_clients WHERE user_id = $1`,
+			`UPDATE users
+			SET username = 'deleted user', email = 'deleted-' || id || '@deleted.invalid', password = '', activated = false, admin = false, version = version + 1
+			WHERE id = $1`,
+		)
+	case DeleteModeHard:
+		queries = append(queries,
+			`DELETE FROM reviews WHERE user_id = $1`,
+			`DELETE FROM users WHERE id = $1`,
+		)
+	default:
+		return fmt.Errorf("unknown delete mode %q", mode)
+	}
+
+	var result sql.Result
+	for _, query := range queries {
+		result, err = tx.ExecContext(ctx, query, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the last query always touches the users row
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return tx.Commit()
+}
+
+/* Store an email address the user wants to change to until they confirm it */
+func (u UserModel) SetPendingEmail(userID int64, email string) error {
+	query := `
+		INSERT INTO email_changes (user_id, email)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET email = EXCLUDED.email, created_at = NOW()
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := u.DB.ExecContext(ctx, query, userID, email)
+	return err
+}
+
+/* Select the email address waiting to be confirmed for a user */
+func (u UserModel) GetPendingEmail(userID int64) (string, error) {
+	query := `
+		SELECT email
+		FROM email_changes
+		WHERE user_id = $1
+	`
+
+	var email string
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := u.DB.QueryRowContext(ctx, query, userID).Scan(&email)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return "", ErrRecordNotFound
+		default:
+			return "", err
+		}
+	}
+	return email, nil
+}
+
+/* Remove a user's pending email change */
+func (u UserModel) DeletePendingEmail(userID int64) error {
+	query := `
+		DELETE FROM email_changes
+		WHERE user_id = $1
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := u.DB.ExecContext(ctx, query, userID)
+	return err
+}
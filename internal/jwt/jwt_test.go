@@ -0,0 +1,138 @@
+package jwt
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	testSecret = []byte("0123456789abcdef0123456789abcdef")
+	testIssuer = "awt-test3"
+	testNow    = time.Unix(1_700_000_000, 0)
+)
+
+func testClaims() Claims {
+	return Claims{
+		Subject:   42,
+		Issuer:    testIssuer,
+		Audience:  testIssuer,
+		IssuedAt:  testNow.Unix(),
+		NotBefore: testNow.Unix(),
+		Expiry:    testNow.Add(15 * time.Minute).Unix(),
+		Activated: true,
+		Admin:     true,
+	}
+}
+
+func mustSign(t *testing.T, claims Claims) string {
+	t.Helper()
+	token, err := Sign(claims, testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+/* Swap the header of a signed token and re-sign it, so only the header differs */
+func withHeader(t *testing.T, headerJSON string) string {
+	t.Helper()
+	parts := strings.Split(mustSign(t, testClaims()), ".")
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(headerJSON)) + "." + parts[1]
+	return unsigned + "." + signature(unsigned, testSecret)
+}
+
+func TestSignParseRoundTrip(t *testing.T) {
+	want := testClaims()
+	token := mustSign(t, want)
+
+	if n := strings.Count(token, "."); n != 2 {
+		t.Fatalf("got %d dots in token, want 2", n)
+	}
+
+	got, err := Parse(token, testSecret, testIssuer, testNow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != want {
+		t.Errorf("got claims %+v, want %+v", *got, want)
+	}
+
+	// still valid one second before expiry
+	_, err = Parse(token, testSecret, testIssuer, time.Unix(want.Expiry-1, 0))
+	if err != nil {
+		t.Errorf("one second before expiry: %v", err)
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	valid := mustSign(t, testClaims())
+	parts := strings.Split(valid, ".")
+
+	expired := testClaims()
+	expired.Expiry = testNow.Unix()
+
+	notYet := testClaims()
+	notYet.NotBefore = testNow.Add(time.Minute).Unix()
+
+	otherIssuer := testClaims()
+	otherIssuer.Issuer = "someone-else"
+
+	noSubject := testClaims()
+	noSubject.Subject = 0
+
+	// flip one character of the signature
+	tampered := []byte(parts[2])
+	if tampered[0] == 'A' {
+		tampered[0] = 'B'
+	} else {
+		tampered[0] = 'A'
+	}
+
+	// change the payload but keep the original signature
+	forged := testClaims()
+	forged.Subject = 1
+	forgedParts := strings.Split(mustSign(t, forged), ".")
+
+	// alg:none tokens, with the signature stripped and with one left on
+	noneSigned := withHeader(t, `{"alg":"none","typ":"JWT"}`)
+	noneUnsigned := noneSigned[:strings.LastIndex(noneSigned, ".")+1]
+
+	tests := []struct {
+		name   string
+		token  string
+		secret []byte
+		want   error
+	}{
+		{"expired", mustSign(t, expired), testSecret, ErrExpiredToken},
+		{"not yet valid", mustSign(t, notYet), testSecret, ErrInvalidToken},
+		{"tampered signature", parts[0] + "." + parts[1] + "." + string(tampered), testSecret, ErrInvalidToken},
+		{"tampered payload", parts[0] + "." + forgedParts[1] + "." + parts[2], testSecret, ErrInvalidToken},
+		{"wrong secret", valid, []byte("a different secret of some length"), ErrInvalidToken},
+		{"alg none unsigned", noneUnsigned, testSecret, ErrInvalidToken},
+		{"alg none signed", noneSigned, testSecret, ErrInvalidToken},
+		{"alg HS512", withHeader(t, `{"alg":"HS512","typ":"JWT"}`), testSecret, ErrInvalidToken},
+		{"alg RS256", withHeader(t, `{"alg":"RS256","typ":"JWT"}`), testSecret, ErrInvalidToken},
+		{"other issuer", mustSign(t, otherIssuer), testSecret, ErrInvalidToken},
+		{"no subject", mustSign(t, noSubject), testSecret, ErrInvalidToken},
+		{"empty", "", testSecret, ErrInvalidToken},
+		{"two parts", parts[0] + "." + parts[1], testSecret, ErrInvalidToken},
+		{"four parts", valid + ".extra", testSecret, ErrInvalidToken},
+		{"not base64 payload", parts[0] + ".!!!." + signature(parts[0]+".!!!", testSecret), testSecret, ErrInvalidToken},
+		{"not json payload", parts[0] + ".bm90IGpzb24." + signature(parts[0]+".bm90IGpzb24", testSecret), testSecret, ErrInvalidToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := Parse(tt.token, tt.secret, testIssuer, testNow)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got error %v, want %v", err, tt.want)
+			}
+			if claims != nil {
+				t.Errorf("got claims %+v, want nil", *claims)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+/* The ASCII secret "12345678901234567890" from the SHA-1 vectors in RFC 6238 appendix B, base32 encoded */
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+/* RFC 6238 lists 8 digit codes, these are their last 6 digits */
+var rfcVectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestCodeAt(t *testing.T) {
+	for _, tt := range rfcVectors {
+		t.Run(tt.code, func(t *testing.T) {
+			got, err := CodeAt(rfcSecret, Step(time.Unix(tt.unix, 0)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.code {
+				t.Errorf("got %q, want %q", got, tt.code)
+			}
+		})
+	}
+
+	// secrets are often typed in lower case
+	got, err := CodeAt("gezdgnbvgy3tqojqgezdgnbvgy3tqojq", Step(time.Unix(59, 0)))
+	if err != nil || got != "287082" {
+		t.Errorf("lower case secret: got %q, %v", got, err)
+	}
+
+	_, err = CodeAt("not base32!", 1)
+	if err == nil {
+		t.Error("expected an error for an invalid secret")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tt := range rfcVectors {
+		step := Step(time.Unix(tt.unix, 0))
+
+		tests := []struct {
+			name  string
+			steps int64
+			ok    bool
+		}{
+			{"same step", 0, true},
+			{"one step late", 1, true},
+			{"one step early", -1, true},
+			{"two steps late", 2, false},
+			{"two steps early", -2, false},
+		}
+
+		for _, tc := range tests {
+			t.Run(tt.code+" "+tc.name, func(t *testing.T) {
+				got, ok := Validate(rfcSecret, tt.code, time.Unix((step+tc.steps)*Period, 0))
+				if ok != tc.ok {
+					t.Fatalf("got ok %t, want %t", ok, tc.ok)
+				}
+				if ok && got != step {
+					t.Errorf("got step %d, want %d", got, step)
+				}
+			})
+		}
+	}
+
+	now := time.Unix(59, 0)
+	for _, code := range []string{"", "28708", "2870820", "94287082", "287083", "abcdef"} {
+		t.Run("reject "+code, func(t *testing.T) {
+			_, ok := Validate(rfcSecret, code, now)
+			if ok {
+				t.Errorf("code %q was accepted", code)
+			}
+		})
+	}
+
+	_, ok := Validate("not base32!", "287082", now)
+	if ok {
+		t.Error("code accepted for an invalid secret")
+	}
+}
@@ -0,0 +1,152 @@
+package validator
+
+import (
+	"bufio"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/hex"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"unicode"
+)
+
+/* Passwords scoring below this many bits are rejected */
+const MinPasswordEntropy = 45.0
+
+/* Length of the SHA-1 prefix used to bucket breached hashes */
+const breachedPrefixLength = 5
+
+/* Small bundled sample of breached password hashes, one upper case SHA-1 per line */
+//go:embed breached_passwords.txt
+var bundledBreached string
+
+/* SHA-1 hashes of breached passwords bucketed by prefix, like the k-anonymity range lookups of Have I Been Pwned */
+type BreachedList struct {
+	ranges map[string]map[string]struct{}
+}
+
+/* Breached list used when validating new passwords */
+var BreachedPasswords = mustBundledBreached()
+
+func mustBundledBreached() *BreachedList {
+	b := &BreachedList{ranges: make(map[string]map[string]struct{})}
+	err := b.load(strings.NewReader(bundledBreached))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+/* Merge breached hashes from a local file into BreachedPasswords; lines are HASH or HASH:COUNT */
+func LoadBreachedPasswords(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return BreachedPasswords.load(f)
+}
+
+func (b *BreachedList) load(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		hash, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if len(hash) != sha1.Size*2 {
+			continue
+		}
+		hash = strings.ToUpper(hash)
+
+		prefix, suffix := hash[:breachedPrefixLength], hash[breachedPrefixLength:]
+		if b.ranges[prefix] == nil {
+			b.ranges[prefix] = make(map[string]struct{})
+		}
+		b.ranges[prefix][suffix] = struct{}{}
+	}
+	return scanner.Err()
+}
+
+/* Check if a password appears in the list */
+func (b *BreachedList) Contains(password string) bool {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	suffixes, ok := b.ranges[hash[:breachedPrefixLength]]
+	if !ok {
+		return false
+	}
+	_, ok = suffixes[hash[breachedPrefixLength:]]
+	return ok
+}
+
+/* Estimate the entropy of a password in bits from its character pool and length */
+func PasswordEntropy(password string) float64 {
+	var lower, upper, digit, symbol, other bool
+	for _, r := range password {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < unicode.MaxASCII:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+
+	pool := 0
+	if lower {
+		pool += 26
+	}
+	if upper {
+		pool += 26
+	}
+	if digit {
+		pool += 10
+	}
+	if symbol {
+		pool += 33
+	}
+	if other {
+		pool += 100
+	}
+	if pool == 0 {
+		return 0
+	}
+
+	// repeated characters and runs like "abcd" or "4321" add almost nothing to guess
+	length := 0
+	var prev rune = -1
+	for _, r := range strings.ToLower(password) {
+		if prev < 0 || (r != prev && r != prev+1 && r != prev-1) {
+			length++
+		}
+		prev = r
+	}
+
+	return float64(length) * math.Log2(float64(pool))
+}
+
+/* Check if a password contains any of the given personal details, such as a username or email */
+func ContainsPersonalInfo(password string, details ...string) bool {
+	password = strings.ToLower(password)
+	for _, detail := range details {
+		detail = strings.ToLower(detail)
+		candidates := []string{detail}
+		if local, _, found := strings.Cut(detail, "@"); found {
+			candidates = append(candidates, local)
+		}
+
+		for _, c := range candidates {
+			if len(c) >= 3 && strings.Contains(password, c) {
+				return true
+			}
+		}
+	}
+	return false
+}
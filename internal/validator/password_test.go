@@ -0,0 +1,103 @@
+package validator
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestPasswordEntropy(t *testing.T) {
+	tests := []struct {
+		password string
+		want     float64
+	}{
+		{"", 0},
+		{"aaaaaaaa", 1 * math.Log2(26)},
+		{"abcdefgh", 1 * math.Log2(26)},
+		{"87654321", 1 * math.Log2(10)},
+		{"password", 7 * math.Log2(26)},
+		{"Password1", 8 * math.Log2(62)},      // the repeated s counts once
+		{"c0rrect-H0rse", 11 * math.Log2(95)}, // rr and the rs run count once each
+		{"naïve", 5 * math.Log2(126)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.password, func(t *testing.T) {
+			got := PasswordEntropy(tt.password)
+			if math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("got %.2f bits, want %.2f", got, tt.want)
+			}
+		})
+	}
+
+	if PasswordEntropy("password") >= MinPasswordEntropy {
+		t.Errorf("password should score below %.0f bits", MinPasswordEntropy)
+	}
+	if PasswordEntropy("c0rrect-H0rse") < MinPasswordEntropy {
+		t.Errorf("c0rrect-H0rse should score at least %.0f bits", MinPasswordEntropy)
+	}
+}
+
+func TestContainsPersonalInfo(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		details  []string
+		want     bool
+	}{
+		{"no details", "jsmith2024!", nil, false},
+		{"username", "jsmith2024!", []string{"jsmith"}, true},
+		{"username any case", "JSmith2024!", []string{"jsmith"}, true},
+		{"full email", "x-jsmith@example.com-x", []string{"jsmith@example.com"}, true},
+		{"email local part", "jsmith2024!", []string{"jsmith@example.com"}, true},
+		{"email domain only", "example.com!", []string{"jsmith@example.com"}, false},
+		{"short detail ignored", "ab-correct-horse", []string{"ab"}, false},
+		{"unrelated", "correct-horse-battery", []string{"jsmith", "jsmith@example.com"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ContainsPersonalInfo(tt.password, tt.details...)
+			if got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBreachedListContains(t *testing.T) {
+	list := &BreachedList{ranges: make(map[string]map[string]struct{})}
+	// SHA-1 of "hunter2", once upper case and once lower case with a count
+	err := list.load(strings.NewReader(
+		"F3BBBD66A63D4BF1747940578EC3D0103530E21D\n" +
+			"5baa61e4c9b93f3f0682250b6cf8331b7ee68fd8:3861493\n" +
+			"not a hash\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		list     *BreachedList
+		password string
+		want     bool
+	}{
+		{list, "hunter2", true},
+		{list, "password", true},
+		{list, "Password", false},
+		{list, "not a hash", false},
+		{list, "correct-horse-battery-staple", false},
+		{BreachedPasswords, "password", true},
+		{BreachedPasswords, "123456", true},
+		{BreachedPasswords, "qwerty", true},
+		{BreachedPasswords, "c0rrect-H0rse-b4ttery", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.password, func(t *testing.T) {
+			got := tt.list.Contains(tt.password)
+			if got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
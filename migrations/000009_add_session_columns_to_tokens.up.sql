@@ -0,0 +1,2 @@
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS created_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW();
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS last_used_at timestamp(0) WITH TIME ZONE;
@@ -0,0 +1,4 @@
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS family bytea;
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS used_at timestamp(0) WITH TIME ZONE;
+
+CREATE INDEX IF NOT EXISTS tokens_family_idx ON tokens (family);
@@ -0,0 +1,2 @@
+ALTER TABLE lists DROP CONSTRAINT IF EXISTS lists_user_id_fkey;
+ALTER TABLE lists ADD CONSTRAINT lists_user_id_fkey FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE;
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS login_attempts (
+    user_id bigint PRIMARY KEY REFERENCES users ON DELETE CASCADE,
+    failed_count integer NOT NULL DEFAULT 0,
+    last_failed_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    locked_until timestamp(0) WITH TIME ZONE,
+    notified_at timestamp(0) WITH TIME ZONE
+);
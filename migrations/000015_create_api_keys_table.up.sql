@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS api_keys (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    name text NOT NULL,
+    hash bytea NOT NULL UNIQUE,
+    prefix text NOT NULL,
+    scopes text[] NOT NULL,
+    created_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    last_used_at timestamp(0) WITH TIME ZONE,
+    expiry timestamp(0) WITH TIME ZONE
+);
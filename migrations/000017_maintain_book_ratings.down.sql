@@ -0,0 +1,4 @@
+DROP TRIGGER IF EXISTS reviews_book_rating ON reviews;
+DROP FUNCTION IF EXISTS reviews_refresh_book_rating();
+DROP FUNCTION IF EXISTS refresh_book_rating(INT);
+ALTER TABLE books DROP COLUMN IF EXISTS review_count;
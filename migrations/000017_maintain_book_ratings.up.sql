@@ -0,0 +1,28 @@
+ALTER TABLE books ADD COLUMN IF NOT EXISTS review_count INT NOT NULL DEFAULT 0;
+
+CREATE OR REPLACE FUNCTION refresh_book_rating(target_book INT) RETURNS void AS $$
+BEGIN
+    UPDATE books
+    SET average_rating = COALESCE((SELECT ROUND(AVG(rating), 2) FROM reviews WHERE book_id = target_book), 0),
+        review_count = (SELECT COUNT(*) FROM reviews WHERE book_id = target_book)
+    WHERE id = target_book;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION reviews_refresh_book_rating() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP IN ('INSERT', 'UPDATE') THEN
+        PERFORM refresh_book_rating(NEW.book_id);
+    END IF;
+    IF TG_OP = 'DELETE' OR (TG_OP = 'UPDATE' AND OLD.book_id IS DISTINCT FROM NEW.book_id) THEN
+        PERFORM refresh_book_rating(OLD.book_id);
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER reviews_book_rating
+AFTER INSERT OR UPDATE OF rating, book_id OR DELETE ON reviews
+FOR EACH ROW EXECUTE FUNCTION reviews_refresh_book_rating();
+
+SELECT refresh_book_rating(id) FROM books;
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS reviews_book_id_idx;
+DROP TRIGGER IF EXISTS review_votes_helpful ON review_votes;
+DROP FUNCTION IF EXISTS review_votes_refresh_helpful();
+DROP TABLE IF EXISTS review_votes;
+ALTER TABLE reviews DROP COLUMN IF EXISTS helpful_count;
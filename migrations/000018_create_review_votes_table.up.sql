@@ -0,0 +1,25 @@
+ALTER TABLE reviews ADD COLUMN IF NOT EXISTS helpful_count INT NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS review_votes (
+    review_id bigint NOT NULL REFERENCES reviews ON DELETE CASCADE,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    created_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (review_id, user_id)
+);
+
+CREATE OR REPLACE FUNCTION review_votes_refresh_helpful() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'INSERT' THEN
+        UPDATE reviews SET helpful_count = helpful_count + 1 WHERE id = NEW.review_id;
+    ELSE
+        UPDATE reviews SET helpful_count = helpful_count - 1 WHERE id = OLD.review_id;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER review_votes_helpful
+AFTER INSERT OR DELETE ON review_votes
+FOR EACH ROW EXECUTE FUNCTION review_votes_refresh_helpful();
+
+CREATE INDEX IF NOT EXISTS reviews_book_id_idx ON reviews (book_id);
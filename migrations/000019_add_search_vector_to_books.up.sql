@@ -0,0 +1,9 @@
+ALTER TABLE books ADD COLUMN IF NOT EXISTS language regconfig NOT NULL DEFAULT 'english';
+
+ALTER TABLE books ADD COLUMN IF NOT EXISTS search_vector tsvector GENERATED ALWAYS AS (
+    setweight(to_tsvector(language, coalesce(title, '')), 'A') ||
+    setweight(to_tsvector(language, coalesce(author, '')), 'B') ||
+    setweight(to_tsvector(language, coalesce(genre, '') || ' ' || coalesce(description, '')), 'C')
+) STORED;
+
+CREATE INDEX IF NOT EXISTS books_search_vector_idx ON books USING GIN (search_vector);